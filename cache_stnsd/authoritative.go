@@ -0,0 +1,69 @@
+package cache_stnsd
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// directory is the time when the full list of a resource was prefetched.
+type directory struct {
+	// Key is the cache key of the list
+	Key      string
+	StoredAt time.Time
+	TTL      time.Duration
+}
+
+func (d directory) remaining(now time.Time) time.Duration {
+	return d.StoredAt.Add(d.TTL).Sub(now)
+}
+
+// lookupResource returns the resource of a lookup by name or id such as "/users?name=example".
+func lookupResource(requestPath, query string) (string, bool) {
+	resource := strings.Trim(path.Clean("/"+requestPath), "/")
+	if resource != "users" && resource != "groups" {
+		return "", false
+	}
+
+	q, err := url.ParseQuery(query)
+	if err != nil || len(q) != 1 {
+		return "", false
+	}
+	for _, k := range []string{"name", "id"} {
+		if v, ok := q[k]; ok && len(v) == 1 && v[0] != "" {
+			return resource, true
+		}
+	}
+	return "", false
+}
+
+// authoritativeNotFound answers a lookup missing from the fresh prefetched list with 404.
+// Every user and group of the list is in the cache, so the lookup doesn't exist in upstream.
+func (h *Http) authoritativeNotFound(requestPath, query string) (*Response, directory, bool) {
+	resource, ok := lookupResource(requestPath, query)
+	if !ok {
+		return nil, directory{}, false
+	}
+
+	gen := h.currentGeneration()
+	d, ok := gen.fresh(resource, time.Now())
+	if !ok {
+		return nil, directory{}, false
+	}
+
+	// the same body and headers as STNS
+	res := jsonResponse(http.StatusNotFound, []byte("{}\n"))
+	gen.idRanges[resource].setHeader(res.Header, resource)
+	return res, d, true
+}
+
+// jsonResponse is a response generated by cache-stnsd in the same form as STNS.
+func jsonResponse(statusCode int, body []byte) *Response {
+	return &Response{
+		StatusCode: statusCode,
+		Header:     http.Header{"Content-Type": {"application/json; charset=UTF-8"}},
+		Body:       body,
+	}
+}
@@ -0,0 +1,86 @@
+package cache_stnsd
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func Test_lookupResource(t *testing.T) {
+	tests := []struct {
+		path  string
+		query string
+		want  string
+		ok    bool
+	}{
+		{"/users", "name=example", "users", true},
+		{"groups/", "id=1000", "groups", true},
+		{"/users", "", "", false},
+		{"/users", "name=", "", false},
+		{"/users", "name=a&id=1", "", false},
+		{"/users", "name=a&name=b", "", false},
+		{"/users", "gid=1", "", false},
+		{"/status", "name=example", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := lookupResource(tt.path, tt.query)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("lookupResource(%s, %s) = %s, %v, want %s, %v", tt.path, tt.query, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestHttp_Authoritative(t *testing.T) {
+	f := newFakeSTNS(t, map[string]string{
+		"/users":  `[{"id":1000,"name":"example","group_id":1000}]`,
+		"/groups": `[{"id":1000,"name":"example"}]`,
+	})
+
+	newHttp := func(authoritative bool) *Http {
+		h := newTestHttp(t, f, Config{
+			NegativeCacheTTL: 10,
+			Cached:           Cached{Prefetch: true, Authoritative: authoritative},
+		})
+		h.PrefetchUserGroups()
+		return h
+	}
+
+	tests := []struct {
+		name          string
+		authoritative bool
+		expire        bool
+		path          string
+		query         string
+		wantStatus    int
+		wantLookups   int
+	}{
+		{"prefetched user", true, false, "/users", "name=example", http.StatusOK, 0},
+		{"missing user", true, false, "/users", "name=missing", http.StatusNotFound, 0},
+		{"missing group id", true, false, "/groups", "id=2000", http.StatusNotFound, 0},
+		{"not a lookup", true, false, "/users", "name=a&id=1", http.StatusNotFound, 1},
+		{"expired list", true, true, "/users", "name=missing", http.StatusNotFound, 1},
+		{"disabled", false, false, "/users", "name=missing", http.StatusNotFound, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHttp(tt.authoritative)
+			if tt.expire {
+				h.generation.directories["users"] = directory{StoredAt: time.Now(), TTL: -time.Second}
+			}
+
+			isCache, res, err := h.Request(tt.path, tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != tt.wantStatus {
+				t.Errorf("status code = %d, want %d", res.StatusCode, tt.wantStatus)
+			}
+			if lookups := f.lookupCount(); lookups != tt.wantLookups {
+				t.Errorf("upstream lookups = %d, want %d", lookups, tt.wantLookups)
+			}
+			if tt.wantLookups == 0 && !isCache {
+				t.Error("response should be answered locally")
+			}
+		})
+	}
+}
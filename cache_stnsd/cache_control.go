@@ -0,0 +1,116 @@
+package cache_stnsd
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseCacheControl returns the directives of Cache-Control with lower case names.
+func parseCacheControl(values []string) map[string]string {
+	directives := map[string]string{}
+	for _, v := range values {
+		for _, d := range strings.Split(v, ",") {
+			d = strings.TrimSpace(d)
+			if d == "" {
+				continue
+			}
+			name, value, _ := strings.Cut(d, "=")
+			directives[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+	return directives
+}
+
+// responseTTL returns the TTL of the response from Cache-Control or Expires of upstream,
+// bounded by min_cache_ttl and max_cache_ttl.
+// defaultTTL such as cache_ttl is used as it is when neither is set.
+// It returns false when the response must not be stored.
+func responseTTL(header http.Header, defaultTTL time.Duration, cached Cached, now time.Time) (time.Duration, bool) {
+	cc := parseCacheControl(header.Values("Cache-Control"))
+	if _, ok := cc["no-store"]; ok {
+		return 0, false
+	}
+	if _, ok := cc["no-cache"]; ok {
+		return 0, false
+	}
+
+	ttl := defaultTTL
+	maxAge, ok := cc["s-maxage"]
+	if !ok {
+		maxAge, ok = cc["max-age"]
+	}
+
+	if ok {
+		sec, err := strconv.Atoi(maxAge)
+		if err != nil {
+			return 0, false
+		}
+		ttl = time.Duration(sec) * time.Second
+	} else if v := header.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			// an invalid date such as "0" means already expired
+			return 0, false
+		}
+
+		base := now
+		if d, err := http.ParseTime(header.Get("Date")); err == nil {
+			base = d
+		}
+		ttl = expires.Sub(base)
+	} else {
+		return defaultTTL, defaultTTL > 0
+	}
+
+	if ttl <= 0 {
+		return 0, false
+	}
+
+	if min := time.Duration(cached.MinCacheTTL) * time.Second; min > 0 && ttl < min {
+		ttl = min
+	}
+	if max := time.Duration(cached.MaxCacheTTL) * time.Second; max > 0 && ttl > max {
+		ttl = max
+	}
+	return ttl, true
+}
+
+// RequestCacheControl is the cache directives of a client request.
+type RequestCacheControl struct {
+	// NoCache fetches from upstream and stores the response again.
+	NoCache bool
+	// OnlyIfCached never contacts upstream.
+	OnlyIfCached bool
+	// MaxAge rejects cache entries older than it. 0 means no limit.
+	MaxAge time.Duration
+}
+
+// ParseRequestCacheControl reads no-cache, only-if-cached and max-age of a client request.
+// max-age=0 is the same as no-cache.
+func ParseRequestCacheControl(header http.Header) RequestCacheControl {
+	cc := parseCacheControl(header.Values("Cache-Control"))
+	r := RequestCacheControl{}
+	if _, ok := cc["no-cache"]; ok {
+		r.NoCache = true
+	}
+	if _, ok := cc["only-if-cached"]; ok {
+		r.OnlyIfCached = true
+	}
+	if v, ok := cc["max-age"]; ok {
+		if sec, err := strconv.Atoi(v); err == nil && sec >= 0 {
+			if sec == 0 {
+				r.NoCache = true
+			} else {
+				r.MaxAge = time.Duration(sec) * time.Second
+			}
+		}
+	}
+	return r
+}
+
+// Bypass reports whether the request skips fresh cache entries.
+func (r RequestCacheControl) Bypass() bool {
+	return r.NoCache || r.MaxAge > 0
+}
@@ -0,0 +1,112 @@
+package cache_stnsd
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func Test_responseTTL(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		header http.Header
+		cached Cached
+		want   time.Duration
+		wantOK bool
+	}{
+		{
+			name:   "default",
+			header: http.Header{},
+			want:   600 * time.Second,
+			wantOK: true,
+		},
+		{
+			name:   "max-age",
+			header: http.Header{"Cache-Control": {"public, max-age=30"}},
+			want:   30 * time.Second,
+			wantOK: true,
+		},
+		{
+			name:   "s-maxage is preferred",
+			header: http.Header{"Cache-Control": {"max-age=30", "s-maxage=60"}},
+			want:   60 * time.Second,
+			wantOK: true,
+		},
+		{
+			name:   "no-store",
+			header: http.Header{"Cache-Control": {"no-store"}},
+		},
+		{
+			name:   "max-age=0",
+			header: http.Header{"Cache-Control": {"max-age=0"}},
+		},
+		{
+			name: "expires",
+			header: http.Header{
+				"Date":    {now.Format(http.TimeFormat)},
+				"Expires": {now.Add(2 * time.Minute).Format(http.TimeFormat)},
+			},
+			want:   2 * time.Minute,
+			wantOK: true,
+		},
+		{
+			name:   "invalid expires",
+			header: http.Header{"Expires": {"0"}},
+		},
+		{
+			name:   "bounded by min",
+			header: http.Header{"Cache-Control": {"max-age=1"}},
+			cached: Cached{MinCacheTTL: 10, MaxCacheTTL: 100},
+			want:   10 * time.Second,
+			wantOK: true,
+		},
+		{
+			name:   "default is not bounded",
+			header: http.Header{},
+			cached: Cached{MinCacheTTL: 700, MaxCacheTTL: 800},
+			want:   600 * time.Second,
+			wantOK: true,
+		},
+		{
+			name:   "bounded by max",
+			header: http.Header{"Cache-Control": {"max-age=3600"}},
+			cached: Cached{MinCacheTTL: 10, MaxCacheTTL: 100},
+			want:   100 * time.Second,
+			wantOK: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := responseTTL(tt.header, 600*time.Second, tt.cached, now)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("responseTTL() = %s, %v, want %s, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestParseRequestCacheControl(t *testing.T) {
+	tests := []struct {
+		value string
+		want  RequestCacheControl
+	}{
+		{"", RequestCacheControl{}},
+		{"no-cache", RequestCacheControl{NoCache: true}},
+		{"only-if-cached", RequestCacheControl{OnlyIfCached: true}},
+		{"max-age=30", RequestCacheControl{MaxAge: 30 * time.Second}},
+		{"max-age=0", RequestCacheControl{NoCache: true}},
+		{"max-age=invalid", RequestCacheControl{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			h := http.Header{}
+			if tt.value != "" {
+				h.Set("Cache-Control", tt.value)
+			}
+			if got := ParseRequestCacheControl(h); got != tt.want {
+				t.Errorf("ParseRequestCacheControl() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package cache_stnsd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CacheStatusName is the cache name in Cache-Status.
+const CacheStatusName = "cache-stnsd"
+
+// CacheStatus is how a request was answered, written as Cache-Status of RFC 9211.
+type CacheStatus struct {
+	Hit bool
+	// Fwd is why the request was forwarded to upstream: "bypass", "miss", "request" or "stale".
+	Fwd       string
+	FwdStatus int
+	Stored    bool
+	// TTL is the remaining lifetime of the entry.
+	// It is negative for an entry kept after expiration because upstream was down.
+	TTL time.Duration
+	// Age is the time since the entry was stored.
+	Age    time.Duration
+	Key    string
+	Detail string
+}
+
+// Stale reports whether the entry was served after its expiration.
+func (s CacheStatus) Stale() bool {
+	return s.Hit && s.TTL < 0
+}
+
+func (s CacheStatus) String() string {
+	params := []string{CacheStatusName}
+	if s.Hit {
+		params = append(params, "hit", fmt.Sprintf("ttl=%d", seconds(s.TTL)))
+	}
+	if s.Fwd != "" {
+		params = append(params, "fwd="+s.Fwd)
+	}
+	if s.FwdStatus != 0 {
+		params = append(params, fmt.Sprintf("fwd-status=%d", s.FwdStatus))
+	}
+	if s.Stored {
+		params = append(params, "stored", fmt.Sprintf("ttl=%d", seconds(s.TTL)))
+	}
+	if s.Key != "" {
+		params = append(params, "key="+strconv.Quote(s.Key))
+	}
+	if s.Detail != "" {
+		params = append(params, "detail="+s.Detail)
+	}
+	return strings.Join(params, "; ")
+}
+
+// seconds rounds d down to seconds, toward negative infinity for expired entries.
+func seconds(d time.Duration) int64 {
+	s := int64(d / time.Second)
+	if d < 0 && d%time.Second != 0 {
+		s--
+	}
+	return s
+}
@@ -0,0 +1,42 @@
+package cache_stnsd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCacheStatus_String(t *testing.T) {
+	tests := []struct {
+		name   string
+		status CacheStatus
+		want   string
+	}{
+		{
+			name:   "hit",
+			status: CacheStatus{Hit: true, TTL: 90500 * time.Millisecond, Key: "http://localhost/users"},
+			want:   `cache-stnsd; hit; ttl=90; key="http://localhost/users"`,
+		},
+		{
+			name:   "fallback",
+			status: CacheStatus{Hit: true, TTL: -1500 * time.Millisecond, Detail: "fallback"},
+			want:   `cache-stnsd; hit; ttl=-2; detail=fallback`,
+		},
+		{
+			name:   "stored",
+			status: CacheStatus{Fwd: "miss", FwdStatus: 200, Stored: true, TTL: 600 * time.Second},
+			want:   `cache-stnsd; fwd=miss; fwd-status=200; stored; ttl=600`,
+		},
+		{
+			name:   "error",
+			status: CacheStatus{Fwd: "stale", Detail: ErrorCodeUpstreamTimeout},
+			want:   `cache-stnsd; fwd=stale; detail=upstream_timeout`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.status.String(); got != tt.want {
+				t.Errorf("String() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
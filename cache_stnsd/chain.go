@@ -0,0 +1,93 @@
+package cache_stnsd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/STNS/libstns-go/libstns"
+)
+
+// Chain uses another cache-stnsd listening on a unix domain socket as upstream.
+// It is selected by api_endpoint = "unix:///path/to/cache-stnsd.sock".
+// The parent's STNSD-CACHE header is returned as STNSD-UPSTREAM-CACHE.
+type Chain struct {
+	socket     string
+	opt        *libstns.Options
+	httpClient *http.Client
+}
+
+func NewChain(endpoint string, opt *libstns.Options) (*Chain, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Path == "" {
+		return nil, fmt.Errorf("unix socket path is empty: %s", endpoint)
+	}
+
+	socket := u.Path
+	return &Chain{
+		socket: socket,
+		opt:    opt,
+		httpClient: &http.Client{
+			Timeout: time.Duration(opt.RequestTimeout) * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+				DisableKeepAlives: !opt.HttpKeepalive,
+			},
+		},
+	}, nil
+}
+
+func isUnixEndpoint(endpoint string) bool {
+	return strings.HasPrefix(endpoint, "unix://")
+}
+
+func (c *Chain) Request(requestPath, query string) (*Response, error) {
+	resp, err := c.do(requestPath, query)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return newResponse(resp)
+}
+
+// Stream is Request which returns the body of 200 as it is read from the parent.
+func (c *Chain) Stream(requestPath, query string) (*Response, io.ReadCloser, error) {
+	resp, err := c.do(requestPath, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	return streamResponse(resp)
+}
+
+func (c *Chain) do(requestPath, query string) (*http.Response, error) {
+	u := url.URL{
+		Scheme:   "http",
+		Host:     "unix",
+		Path:     path.Join("/", requestPath),
+		RawQuery: query,
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range c.opt.HttpHeaders {
+		req.Header.Add(k, v)
+	}
+	req.Header.Set("User-Agent", c.opt.UserAgent)
+	return c.httpClient.Do(req)
+}
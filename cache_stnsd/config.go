@@ -1,7 +1,14 @@
 package cache_stnsd
 
 import (
+	"fmt"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/STNS/libstns-go/libstns"
@@ -13,6 +20,7 @@ type Config struct {
 	AuthToken        string            `toml:"auth_token"`
 	User             string            `toml:"user"`
 	Password         string            `toml:"password"`
+	QueryWrapper     string            `toml:"query_wrapper"`
 	SSLVerify        bool              `toml:"ssl_verify"`
 	HttpProxy        string            `toml:"http_proxy"`
 	HttpKeepalive    bool              `toml:"http_keepalive"`
@@ -28,11 +36,118 @@ type Config struct {
 	LogFile          string            `toml:"-"`
 	LogLevel         string            `toml:"-"`
 	Cached           Cached            `toml:"cached"`
+	Include          []string          `toml:"include"`
 }
 
 type Cached struct {
-	Prefetch   bool   `toml:"prefetch"`
-	UnixSocket string `toml:"unix_socket"`
+	Prefetch     bool   `toml:"prefetch"`
+	UnixSocket   string `toml:"unix_socket"`
+	SocketMode   string `toml:"socket_mode"`
+	SocketOwner  string `toml:"socket_owner"`
+	SocketGroup  string `toml:"socket_group"`
+	ReadyTimeout int    `toml:"ready_timeout"`
+	// Listen is an optional tcp address such as "127.0.0.1:1105" served with the unix socket.
+	Listen string `toml:"listen"`
+	// TLS is the server certificate for Listen.
+	// Client certificates are verified by CA when it is set.
+	TLS libstns.TLS `toml:"tls"`
+	// AllowPaths are the paths proxied in addition to users, groups and status.
+	AllowPaths []string `toml:"allow_paths"`
+	// MaxQueryLength limits the length of the query string. 0 means unlimited.
+	MaxQueryLength int `toml:"max_query_length"`
+	// MinCacheTTL and MaxCacheTTL bound the TTL from Cache-Control or Expires of upstream.
+	// 0 means unbounded.
+	MinCacheTTL int `toml:"min_cache_ttl"`
+	MaxCacheTTL int `toml:"max_cache_ttl"`
+	// BypassRootOnly ignores no-cache and max-age of requests from users other than root.
+	BypassRootOnly bool `toml:"bypass_root_only"`
+	// Authoritative answers lookups missing from a fresh prefetch with 404 without asking upstream.
+	Authoritative bool `toml:"authoritative"`
+	// MaxDeletions and MaxDeletionPercent refuse a prefetch which deletes more users or groups
+	// than them compared to the previous prefetch. 0 means unlimited.
+	MaxDeletions       int `toml:"max_deletions"`
+	MaxDeletionPercent int `toml:"max_deletion_percent"`
+	// PrefetchInterval is the seconds between prefetches. 0 means half of cache_ttl.
+	PrefetchInterval int `toml:"prefetch_interval"`
+	// PrefetchJitter adds random seconds up to it to each interval.
+	PrefetchJitter int `toml:"prefetch_jitter"`
+	// PrefetchMaxBackoff bounds the retry doubled after each failure. 0 means the interval.
+	PrefetchMaxBackoff int `toml:"prefetch_max_backoff"`
+	// Warmup is "block" to accept connections after the first prefetch or ready_timeout,
+	// or "serve" to accept them right away. The default is "serve".
+	Warmup string `toml:"warmup"`
+	// PrefetchPaths are the paths prefetched with users and groups.
+	PrefetchPaths []PrefetchPath `toml:"prefetch_paths"`
+}
+
+// PrefetchPath is a path which returns a list, such as a resource of a STNS extension.
+type PrefetchPath struct {
+	Path string `toml:"path" json:"path"`
+	// Index are the fields of the items to build lookups such as "name=value".
+	Index []string `toml:"index" json:"index"`
+}
+
+// Resource returns the path without slashes, the same as users and groups.
+func (p PrefetchPath) Resource() string {
+	return strings.Trim(path.Clean("/"+p.Path), "/")
+}
+
+const (
+	WarmupServe = "serve"
+	WarmupBlock = "block"
+)
+
+// MinPrefetchInterval is the shortest interval of prefetch.
+const MinPrefetchInterval = 5 * time.Second
+
+// PrefetchPeriod returns the interval of prefetch, half of cache_ttl by default.
+func (c *Config) PrefetchPeriod() time.Duration {
+	interval := time.Duration(c.Cached.PrefetchInterval) * time.Second
+	if interval == 0 {
+		interval = time.Duration(c.CacheTTL) * time.Second / 2
+	}
+	if interval < MinPrefetchInterval {
+		return MinPrefetchInterval
+	}
+	return interval
+}
+
+// PrefetchRetryBase is the first retry after a failed prefetch.
+const PrefetchRetryBase = MinPrefetchInterval
+
+// PrefetchBackoff returns the longest retry after failures, the interval by default
+// so that a failure doesn't delay the refresh past cache_ttl.
+func (c *Config) PrefetchBackoff() time.Duration {
+	if c.Cached.PrefetchMaxBackoff > 0 {
+		return time.Duration(c.Cached.PrefetchMaxBackoff) * time.Second
+	}
+	return c.PrefetchPeriod()
+}
+
+var defaultAllowPaths = []string{
+	"users",
+	"groups",
+	"status",
+}
+
+// AllowPath reports whether the request path is a STNS API resource or one of allow_paths.
+func (c Cached) AllowPath(requestPath string) bool {
+	p := strings.Trim(path.Clean("/"+requestPath), "/")
+	for _, a := range append(defaultAllowPaths, c.AllowPaths...) {
+		if p == strings.Trim(a, "/") {
+			return true
+		}
+	}
+	return false
+}
+
+// SocketFileMode parses socket_mode as an octal permission such as "0660".
+func (c Cached) SocketFileMode() (os.FileMode, error) {
+	m, err := strconv.ParseUint(c.SocketMode, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, fmt.Errorf("socket_mode is invalid: %s", c.SocketMode)
+	}
+	return os.FileMode(m), nil
 }
 
 func defaultConfig(config *Config) {
@@ -47,22 +162,214 @@ func defaultConfig(config *Config) {
 	config.RequestLocktime = 60
 	config.Cached.UnixSocket = "/var/run/stnsd.sock"
 	config.Cached.Prefetch = true
+	config.Cached.SocketMode = "0777"
+	config.Cached.ReadyTimeout = 10
+	config.Cached.MaxQueryLength = 1024
+	config.Cached.MaxDeletionPercent = 50
 }
 
+// LoadConfig reads the config file and then the files in "<filePath>.d/*.toml"
+// and the files matched by include, in lexical order.
+// Each file is merged on top of the previous ones:
+// scalar values are overwritten, tables such as [tls] and [cached] are merged
+// key by key, maps such as [http_headers] are merged key by key and arrays are replaced.
+// include is only read from the main config file.
 func LoadConfig(filePath string) (*Config, error) {
+	config, _, err := LoadConfigWithMeta(filePath)
+	return config, err
+}
+
+// ConfigMeta records where each value of the config came from.
+type ConfigMeta struct {
+	// Sources maps a dotted toml key (e.g. "cached.prefetch") to the file that set it last.
+	Sources map[string]string
+	// Undecoded holds the keys that are not used by cache-stnsd, as "file: key".
+	Undecoded []string
+}
+
+// LoadConfigWithMeta is LoadConfig that also returns the source of each value.
+func LoadConfigWithMeta(filePath string) (*Config, *ConfigMeta, error) {
 	var config Config
 
 	defaultConfig(&config)
+	meta := &ConfigMeta{
+		Sources: map[string]string{},
+	}
 
 	_, err := os.Stat(filePath)
 	if os.IsNotExist(err) {
 		logrus.Warn(err)
-		return &config, nil
+	} else {
+		if err := meta.decodeFile(filePath, &config); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	files, err := includeFiles(filePath, config.Include)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	include := config.Include
+	for _, f := range files {
+		logrus.Debugf("load config: %s", f)
+		if err := meta.decodeFile(f, &config); err != nil {
+			return nil, nil, fmt.Errorf("%s: %s", f, err.Error())
+		}
 	}
+	config.Include = include
+	return &config, meta, nil
+}
 
-	_, err = toml.DecodeFile(filePath, &config)
+func (m *ConfigMeta) decodeFile(filePath string, config *Config) error {
+	md, err := toml.DecodeFile(filePath, config)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	for _, k := range md.Keys() {
+		m.Sources[k.String()] = filePath
+	}
+
+	for _, k := range md.Undecoded() {
+		m.Undecoded = append(m.Undecoded, fmt.Sprintf("%s: %s", filePath, k.String()))
+	}
+	return nil
+}
+
+func includeFiles(filePath string, include []string) ([]string, error) {
+	patterns := []string{filepath.Join(filePath+".d", "*.toml")}
+	for _, p := range include {
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(filepath.Dir(filePath), p)
+		}
+		patterns = append(patterns, p)
+	}
+
+	files := []string{}
+	found := map[string]bool{}
+	for _, p := range patterns {
+
+		matches, err := filepath.Glob(p)
+		if err != nil {
+			return nil, fmt.Errorf("include pattern is invalid: %s", p)
+		}
+
+		for _, m := range matches {
+			if found[m] {
+				continue
+			}
+			found[m] = true
+			files = append(files, m)
+		}
+	}
+	return files, nil
+}
+
+// Validate checks the values that can not be used to start or reload the server.
+func (c *Config) Validate() error {
+	if c.QueryWrapper == "" {
+		u, err := url.Parse(c.ApiEndpoint)
+		if err != nil {
+			return fmt.Errorf("api_endpoint is invalid: %s", err.Error())
+		}
+		if u.Scheme == "" {
+			return fmt.Errorf("api_endpoint is invalid: %s", c.ApiEndpoint)
+		}
+	}
+
+	if c.Cache && c.CacheTTL <= 0 {
+		return fmt.Errorf("cache_ttl must be greater than 0: %d", c.CacheTTL)
+	}
+
+	if c.NegativeCacheTTL < 0 {
+		return fmt.Errorf("negative_cache_ttl must not be negative: %d", c.NegativeCacheTTL)
+	}
+
+	if c.RequestTimeout < 0 {
+		return fmt.Errorf("request_timeout must not be negative: %d", c.RequestTimeout)
+	}
+
+	if c.RequestRetry < 0 {
+		return fmt.Errorf("request_retry must not be negative: %d", c.RequestRetry)
+	}
+
+	if _, err := c.Cached.SocketFileMode(); err != nil {
+		return err
+	}
+
+	if c.Cached.MaxQueryLength < 0 {
+		return fmt.Errorf("max_query_length must not be negative: %d", c.Cached.MaxQueryLength)
+	}
+
+	if c.Cached.MinCacheTTL < 0 || c.Cached.MaxCacheTTL < 0 {
+		return fmt.Errorf("min_cache_ttl and max_cache_ttl must not be negative")
+	}
+
+	if c.Cached.MaxCacheTTL > 0 && c.Cached.MinCacheTTL > c.Cached.MaxCacheTTL {
+		return fmt.Errorf("min_cache_ttl must not be greater than max_cache_ttl: %d > %d", c.Cached.MinCacheTTL, c.Cached.MaxCacheTTL)
+	}
+
+	if c.Cached.Authoritative && !(c.Cache && c.Cached.Prefetch) {
+		return fmt.Errorf("authoritative in [cached] requires cache and prefetch")
+	}
+
+	if c.Cached.MaxDeletions < 0 {
+		return fmt.Errorf("max_deletions must not be negative: %d", c.Cached.MaxDeletions)
+	}
+
+	if c.Cached.MaxDeletionPercent < 0 || c.Cached.MaxDeletionPercent > 100 {
+		return fmt.Errorf("max_deletion_percent must be between 0 and 100: %d", c.Cached.MaxDeletionPercent)
+	}
+
+	if c.Cached.PrefetchInterval < 0 || c.Cached.PrefetchJitter < 0 || c.Cached.PrefetchMaxBackoff < 0 {
+		return fmt.Errorf("prefetch_interval, prefetch_jitter and prefetch_max_backoff must not be negative")
+	}
+
+	if c.Cached.PrefetchInterval > 0 && time.Duration(c.Cached.PrefetchInterval)*time.Second < MinPrefetchInterval {
+		return fmt.Errorf("prefetch_interval must be at least %d: %d", MinPrefetchInterval/time.Second, c.Cached.PrefetchInterval)
+	}
+
+	if c.Cached.PrefetchMaxBackoff > 0 && c.PrefetchBackoff() < c.PrefetchPeriod() {
+		return fmt.Errorf("prefetch_max_backoff must be at least the prefetch interval %d: %d",
+			c.PrefetchPeriod()/time.Second, c.Cached.PrefetchMaxBackoff)
+	}
+
+	for _, p := range c.Cached.PrefetchPaths {
+		switch p.Resource() {
+		case "", "users", "groups":
+			return fmt.Errorf("prefetch_paths has an invalid path: %s", p.Path)
+		}
+		if !c.Cached.AllowPath(p.Path) {
+			return fmt.Errorf("prefetch path %s is not in allow_paths", p.Path)
+		}
+	}
+
+	switch c.Cached.Warmup {
+	case "", WarmupServe, WarmupBlock:
+	default:
+		return fmt.Errorf("warmup must be %s or %s: %s", WarmupServe, WarmupBlock, c.Cached.Warmup)
+	}
+
+	if c.Cached.ReadyTimeout < 0 {
+		return fmt.Errorf("ready_timeout must not be negative: %d", c.Cached.ReadyTimeout)
+	}
+
+	if (c.Cached.TLS.Cert == "") != (c.Cached.TLS.Key == "") {
+		return fmt.Errorf("both cert and key are required in [cached.tls]")
+	}
+
+	if c.Cached.TLS.CA != "" && c.Cached.TLS.Cert == "" {
+		return fmt.Errorf("ca in [cached.tls] requires cert and key")
+	}
+
+	for _, f := range []string{c.TLS.CA, c.TLS.Cert, c.TLS.Key, c.Cached.TLS.CA, c.Cached.TLS.Cert, c.Cached.TLS.Key} {
+		if f == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			return fmt.Errorf("tls file is invalid: %s", err.Error())
+		}
 	}
-	return &config, nil
+	return nil
 }
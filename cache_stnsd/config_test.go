@@ -42,6 +42,7 @@ func Test_LoadConfig(t *testing.T) {
 				AuthToken:        "xxxxxxxxxxxxxxx",
 				User:             "test_user",
 				Password:         "test_password",
+				QueryWrapper:     "/usr/local/bin/stns-wrapper",
 				SSLVerify:        true,
 				HttpProxy:        "http://your.proxy.com",
 				RequestTimeout:   1,
@@ -59,8 +60,12 @@ func Test_LoadConfig(t *testing.T) {
 					Key:  "example_key",
 				},
 				Cached: Cached{
-					UnixSocket: "/var/run/stnsd.sock",
-					Prefetch:   true,
+					UnixSocket:         "/var/run/stnsd.sock",
+					Prefetch:           true,
+					SocketMode:         "0777",
+					ReadyTimeout:       10,
+					MaxQueryLength:     1024,
+					MaxDeletionPercent: 50,
 				},
 				HttpKeepalive: false,
 			},
@@ -91,12 +96,53 @@ func Test_LoadConfig(t *testing.T) {
 					Key:  "",
 				},
 				Cached: Cached{
-					UnixSocket: "/var/run/stnsd.sock",
-					Prefetch:   true,
+					UnixSocket:         "/var/run/stnsd.sock",
+					Prefetch:           true,
+					SocketMode:         "0777",
+					ReadyTimeout:       10,
+					MaxQueryLength:     1024,
+					MaxDeletionPercent: 50,
 				},
 				HttpKeepalive: true,
 			},
 		},
+		{
+			name: "include ok",
+			args: args{
+				filePath: "./testdata/include.conf",
+			},
+
+			want: &Config{
+				ApiEndpoint:      "http://localhost:1104/v1",
+				SSLVerify:        true,
+				RequestTimeout:   10,
+				RequestRetry:     3,
+				RequestLocktime:  60,
+				Cache:            true,
+				CacheTTL:         120,
+				NegativeCacheTTL: 60,
+				HttpHeaders: map[string]string{
+					"X-API-TOKEN": "token",
+					"X-HOST":      "conf.d",
+					"X-EXTRA":     "extra",
+				},
+				TLS: libstns.TLS{
+					CA:   "ca_cert",
+					Cert: "example_cert",
+					Key:  "example_key",
+				},
+				Cached: Cached{
+					UnixSocket:         "/run/cache-stnsd.sock",
+					Prefetch:           false,
+					SocketMode:         "0777",
+					ReadyTimeout:       10,
+					MaxQueryLength:     1024,
+					MaxDeletionPercent: 50,
+				},
+				HttpKeepalive: true,
+				Include:       []string{"include/*.toml"},
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -111,3 +157,164 @@ func Test_LoadConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestConfig_Validate(t *testing.T) {
+	valid := func() *Config {
+		c, _ := LoadConfig("./testdata/empty.conf")
+		return c
+	}
+	tests := []struct {
+		name    string
+		modify  func(*Config)
+		wantErr bool
+	}{
+		{
+			name:   "ok",
+			modify: func(c *Config) {},
+		},
+		{
+			name:    "invalid endpoint",
+			modify:  func(c *Config) { c.ApiEndpoint = "/v1" },
+			wantErr: true,
+		},
+		{
+			name: "query wrapper without endpoint",
+			modify: func(c *Config) {
+				c.ApiEndpoint = ""
+				c.QueryWrapper = "/usr/local/bin/stns-wrapper"
+			},
+		},
+		{
+			name:    "invalid socket mode",
+			modify:  func(c *Config) { c.Cached.SocketMode = "rwxrwxrwx" },
+			wantErr: true,
+		},
+		{
+			name:    "cached tls without key",
+			modify:  func(c *Config) { c.Cached.TLS.Cert = "./testdata/full.conf" },
+			wantErr: true,
+		},
+		{
+			name:    "zero cache ttl",
+			modify:  func(c *Config) { c.CacheTTL = 0 },
+			wantErr: true,
+		},
+		{
+			name:    "negative cache ttl",
+			modify:  func(c *Config) { c.NegativeCacheTTL = -1 },
+			wantErr: true,
+		},
+		{
+			name: "authoritative without prefetch",
+			modify: func(c *Config) {
+				c.Cached.Prefetch = false
+				c.Cached.Authoritative = true
+			},
+			wantErr: true,
+		},
+		{
+			name:    "deletion percent over 100",
+			modify:  func(c *Config) { c.Cached.MaxDeletionPercent = 101 },
+			wantErr: true,
+		},
+		{
+			name:    "short prefetch interval",
+			modify:  func(c *Config) { c.Cached.PrefetchInterval = 1 },
+			wantErr: true,
+		},
+		{
+			name:    "negative prefetch jitter",
+			modify:  func(c *Config) { c.Cached.PrefetchJitter = -1 },
+			wantErr: true,
+		},
+		{
+			name:    "max backoff shorter than the interval",
+			modify:  func(c *Config) { c.Cached.PrefetchInterval = 60; c.Cached.PrefetchMaxBackoff = 30 },
+			wantErr: true,
+		},
+		{
+			name:   "max backoff",
+			modify: func(c *Config) { c.Cached.PrefetchInterval = 60; c.Cached.PrefetchMaxBackoff = 60 },
+		},
+		{
+			name:    "invalid warmup",
+			modify:  func(c *Config) { c.Cached.Warmup = "wait" },
+			wantErr: true,
+		},
+		{
+			name: "prefetch path",
+			modify: func(c *Config) {
+				c.Cached.AllowPaths = []string{"hosts"}
+				c.Cached.PrefetchPaths = []PrefetchPath{{Path: "/hosts", Index: []string{"name"}}}
+			},
+		},
+		{
+			name: "prefetch path not allowed",
+			modify: func(c *Config) {
+				c.Cached.PrefetchPaths = []PrefetchPath{{Path: "hosts"}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "prefetch path of users",
+			modify: func(c *Config) {
+				c.Cached.PrefetchPaths = []PrefetchPath{{Path: "/users/"}}
+			},
+			wantErr: true,
+		},
+		{
+			name:    "missing tls file",
+			modify:  func(c *Config) { c.TLS.CA = "./testdata/notfound.pem" },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid()
+			tt.modify(c)
+			if err := c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_LoadConfigWithMeta(t *testing.T) {
+	_, meta, err := LoadConfigWithMeta("./testdata/unknown.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantUndecoded := []string{
+		"./testdata/unknown.conf: uid_shift",
+		"./testdata/unknown.conf: cached.unknown",
+	}
+	if !reflect.DeepEqual(meta.Undecoded, wantUndecoded) {
+		t.Errorf("Undecoded = %v, want %v", meta.Undecoded, wantUndecoded)
+	}
+
+	if meta.Sources["cached.prefetch"] != "./testdata/unknown.conf" {
+		t.Errorf("Sources = %v", meta.Sources)
+	}
+
+	if _, ok := meta.Sources["cache_ttl"]; ok {
+		t.Errorf("cache_ttl should be default: %v", meta.Sources)
+	}
+}
+
+func TestCached_AllowPath(t *testing.T) {
+	c := Cached{AllowPaths: []string{"/extra/"}}
+	for p, want := range map[string]bool{
+		"/users":     true,
+		"/groups/":   true,
+		"status":     true,
+		"/extra":     true,
+		"/get":       false,
+		"/users/../": false,
+		"/":          false,
+	} {
+		if got := c.AllowPath(p); got != want {
+			t.Errorf("AllowPath(%s) = %v, want %v", p, got, want)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package cache_stnsd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/STNS/STNS/v2/model"
+)
+
+// principalEntry is an item decoded from a prefetched list such as a user or a group.
+type principalEntry struct {
+	name string
+	id   int
+	// group is set for groups to build the memberships
+	group *model.Group
+	// queries are the lookups answered by body, such as "name=example" and "id=1000"
+	queries []string
+	// body is the response of the lookups, shared by all of them
+	body []byte
+}
+
+// decodeBatchSize is the number of principals passed to a worker at once.
+const decodeBatchSize = 256
+
+type rawBatch struct {
+	index int
+	// bodies are the items wrapped in a list, see wrapList
+	bodies [][]byte
+}
+
+// decodePrincipals reads the list of users or groups one principal at a time,
+// and decodes them with the workers in parallel. The order of the list is kept.
+func decodePrincipals(r io.Reader, resource string, workers int) ([]principalEntry, error) {
+	if resource != "users" && resource != "groups" {
+		return nil, fmt.Errorf("unknown resource: %s", resource)
+	}
+	return decodeList(r, resource, workers, func(body []byte) (principalEntry, error) {
+		return decodePrincipal(body, resource)
+	})
+}
+
+// decodeIndexed reads a list of any resource, and indexes the items by the fields.
+// Fields which are not a string or a number are not indexed.
+func decodeIndexed(r io.Reader, resource string, fields []string, workers int) ([]principalEntry, error) {
+	return decodeList(r, resource, workers, func(body []byte) (principalEntry, error) {
+		e := principalEntry{}
+		item := map[string]json.RawMessage{}
+		if err := json.Unmarshal(listItem(body), &item); err != nil {
+			return e, err
+		}
+
+		for _, f := range fields {
+			v, ok := item[f]
+			if !ok {
+				continue
+			}
+
+			var s string
+			var n json.Number
+			if err := json.Unmarshal(v, &s); err == nil {
+				e.queries = append(e.queries, lookupQuery(f, s))
+			} else if err := json.Unmarshal(v, &n); err == nil {
+				e.queries = append(e.queries, lookupQuery(f, n.String()))
+			}
+		}
+		e.body = body
+		return e, nil
+	})
+}
+
+// decodeList reads a list one item at a time, and decodes the items with the workers in parallel.
+// decode is called with the item wrapped in a list, which can be kept as the body of the lookup.
+func decodeList(r io.Reader, resource string, workers int, decode func(body []byte) (principalEntry, error)) ([]principalEntry, error) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	dec := json.NewDecoder(r)
+	t, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if d, ok := t.(json.Delim); !ok || d != '[' {
+		return nil, fmt.Errorf("%s is not a list", resource)
+	}
+
+	batches := make(chan rawBatch, workers)
+	var mu sync.Mutex
+	results := map[int][]principalEntry{}
+	var decodeErr error
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range batches {
+				entries := make([]principalEntry, 0, len(b.bodies))
+				var berr error
+				for _, body := range b.bodies {
+					e, err := decode(body)
+					if err != nil {
+						berr = err
+						break
+					}
+					entries = append(entries, e)
+				}
+
+				mu.Lock()
+				if berr != nil && decodeErr == nil {
+					decodeErr = berr
+				}
+				results[b.index] = entries
+				mu.Unlock()
+			}
+		}()
+	}
+
+	n := 0
+	total := 0
+	// the buffer of the decoder is reused, and only the wrapped body is allocated for each item
+	var raw json.RawMessage
+	bodies := make([][]byte, 0, decodeBatchSize)
+	for dec.More() {
+		if err = dec.Decode(&raw); err != nil {
+			break
+		}
+		bodies = append(bodies, wrapList(raw))
+		total++
+		if len(bodies) == decodeBatchSize {
+			batches <- rawBatch{index: n, bodies: bodies}
+			bodies = make([][]byte, 0, decodeBatchSize)
+			n++
+		}
+	}
+	if len(bodies) > 0 {
+		batches <- rawBatch{index: n, bodies: bodies}
+		n++
+	}
+	close(batches)
+	wg.Wait()
+
+	if err != nil {
+		return nil, err
+	}
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+
+	entries := make([]principalEntry, 0, total)
+	for i := 0; i < n; i++ {
+		entries = append(entries, results[i]...)
+	}
+	return entries, nil
+}
+
+func decodePrincipal(body []byte, resource string) (principalEntry, error) {
+	e := principalEntry{}
+	raw := listItem(body)
+	if resource == "groups" {
+		g := &model.Group{}
+		if err := json.Unmarshal(raw, g); err != nil {
+			return e, err
+		}
+		e.name, e.id, e.group = g.Name, g.ID, g
+	} else {
+		u := struct {
+			ID   int    `json:"id"`
+			Name string `json:"name"`
+		}{}
+		if err := json.Unmarshal(raw, &u); err != nil {
+			return e, err
+		}
+		e.name, e.id = u.Name, u.ID
+	}
+
+	e.queries = []string{lookupQuery("name", e.name), lookupQuery("id", strconv.Itoa(e.id))}
+	e.body = body
+	return e, nil
+}
+
+// lookupQuery returns the query of a lookup by the field, escaped like the cache key.
+func lookupQuery(field, value string) string {
+	return url.Values{field: {value}}.Encode()
+}
+
+// wrapList returns a copy of the item in a list like the lookup of STNS.
+func wrapList(raw []byte) []byte {
+	b := make([]byte, len(raw)+2)
+	b[0] = '['
+	copy(b[1:], raw)
+	b[len(b)-1] = ']'
+	return b
+}
+
+// listItem returns the item of the body made by wrapList without copying it.
+func listItem(body []byte) []byte {
+	return body[1 : len(body)-1]
+}
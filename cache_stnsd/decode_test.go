@@ -0,0 +1,355 @@
+package cache_stnsd
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_decodePrincipals(t *testing.T) {
+	tests := []struct {
+		name      string
+		resource  string
+		body      string
+		wantNames []string
+		wantBody  string
+		wantErr   bool
+	}{
+		{
+			name:      "users",
+			resource:  "users",
+			body:      `[{"id":1,"name":"a","keys":["k"]}, {"id":2,"name":"b"}, {"id":3,"name":"c"}]`,
+			wantNames: []string{"a", "b", "c"},
+			wantBody:  `[{"id":1,"name":"a","keys":["k"]}]`,
+		},
+		{
+			name:      "groups",
+			resource:  "groups",
+			body:      `[{"id":1,"name":"dev","users":["a"]}]`,
+			wantNames: []string{"dev"},
+			wantBody:  `[{"id":1,"name":"dev","users":["a"]}]`,
+		},
+		{
+			name:      "empty",
+			resource:  "users",
+			body:      `[]`,
+			wantNames: []string{},
+		},
+		{
+			name:     "not a list",
+			resource: "users",
+			body:     `{"id":1}`,
+			wantErr:  true,
+		},
+		{
+			name:     "invalid principal",
+			resource: "users",
+			body:     `[{"id":"1","name":"a"}]`,
+			wantErr:  true,
+		},
+		{
+			name:     "truncated",
+			resource: "users",
+			body:     `[{"id":1,"name":"a"},`,
+			wantErr:  true,
+		},
+		{
+			name:     "unknown resource",
+			resource: "hosts",
+			body:     `[]`,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := decodePrincipals(strings.NewReader(tt.body), tt.resource, 2)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodePrincipals() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			names := []string{}
+			for _, e := range entries {
+				names = append(names, e.name)
+			}
+			if !reflect.DeepEqual(names, tt.wantNames) {
+				t.Errorf("names = %v, want %v", names, tt.wantNames)
+			}
+			if len(entries) > 0 && string(entries[0].body) != tt.wantBody {
+				t.Errorf("body = %s, want %s", entries[0].body, tt.wantBody)
+			}
+			if tt.resource == "groups" && len(entries) > 0 && entries[0].group == nil {
+				t.Error("group should be decoded")
+			}
+		})
+	}
+}
+
+func Test_decodeIndexed(t *testing.T) {
+	body := `[
+		{"name":"web1","id":10,"ip":"192.0.2.1","tags":["a"]},
+		{"name":"web2","id":11.5,"enabled":true},
+		{"id":12}
+	]`
+	entries, err := decodeIndexed(strings.NewReader(body), "hosts", []string{"name", "id", "tags", "enabled"}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := [][]string{}
+	for _, e := range entries {
+		got = append(got, e.queries)
+	}
+	want := [][]string{
+		{"name=web1", "id=10"},
+		{"name=web2", "id=11.5"},
+		{"id=12"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("queries = %v, want %v", got, want)
+	}
+	if string(entries[2].body) != `[{"id":12}]` {
+		t.Errorf("body = %s", entries[2].body)
+	}
+
+	if _, err := decodeIndexed(strings.NewReader(`["web1"]`), "hosts", []string{"name"}, 1); err == nil {
+		t.Error("items which are not an object should be an error")
+	}
+}
+
+func TestHttp_PrefetchPaths(t *testing.T) {
+	f := newFakeSTNS(t, map[string]string{
+		"/users": `[{"id":1000,"name":"alice"}]`,
+		"/hosts": `[{"name":"web1","ip":"192.0.2.1"}]`,
+		"/keys":  `[{"name":"deploy"}]`,
+	})
+	h := newTestHttp(t, f, Config{
+		Cached: Cached{
+			AllowPaths: []string{"hosts", "keys"},
+			PrefetchPaths: []PrefetchPath{
+				{Path: "/hosts/", Index: []string{"name", "ip"}},
+				{Path: "keys", Index: []string{"name"}},
+			},
+		},
+	})
+	if err := h.PrefetchUserGroups(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, q := range []string{"", "name=web1", "ip=192.0.2.1"} {
+		if !isCached(h, "hosts", q) {
+			t.Errorf("hosts?%s should be cached", q)
+		}
+	}
+
+	f.setStatus("/hosts", http.StatusInternalServerError)
+	f.setList("/users", `[{"id":1001,"name":"bob"}]`)
+	f.setList("/keys", `[{"name":"backup"}]`)
+	if err := h.PrefetchUserGroups(); err == nil {
+		t.Error("failure of a prefetch path should be returned")
+	}
+
+	// only the failing path keeps the previous entries
+	for _, q := range []string{"", "name=web1", "ip=192.0.2.1"} {
+		if !isCached(h, "hosts", q) {
+			t.Errorf("hosts?%s should be kept", q)
+		}
+	}
+	tests := []struct {
+		resource string
+		query    string
+		want     bool
+	}{
+		{"users", "name=bob", true},
+		{"users", "name=alice", false},
+		{"keys", "name=backup", true},
+		{"keys", "name=deploy", false},
+	}
+	for _, tt := range tests {
+		if got := isCached(h, tt.resource, tt.query); got != tt.want {
+			t.Errorf("%s?%s is cached = %v, want %v", tt.resource, tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestHttp_PrefetchEscapedIndex(t *testing.T) {
+	f := newFakeSTNS(t, map[string]string{
+		"/users": `[{"id":1000,"name":"a&b"}]`,
+		"/hosts": `[{"name":"web 1","note":"a=b?"}]`,
+	})
+	h := newTestHttp(t, f, Config{
+		Cached: Cached{
+			AllowPaths:    []string{"hosts"},
+			PrefetchPaths: []PrefetchPath{{Path: "hosts", Index: []string{"name", "note"}}},
+		},
+	})
+	if err := h.PrefetchUserGroups(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		resource string
+		query    string
+	}{
+		{"users", "name=a%26b"},
+		{"hosts", "name=web+1"},
+		{"hosts", "name=web%201"},
+		{"hosts", "note=a%3Db%3F"},
+	}
+	for _, tt := range tests {
+		isCache, res, err := h.Request(tt.resource, tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isCache || res.StatusCode != http.StatusOK {
+			t.Errorf("%s?%s should be prefetched: %v %d", tt.resource, tt.query, isCache, res.StatusCode)
+		}
+	}
+	if lookups := f.lookupCount(); lookups != 0 {
+		t.Errorf("upstream lookups = %d, want 0", lookups)
+	}
+}
+
+func Test_decodePrincipalsOrder(t *testing.T) {
+	body := syntheticUsers(1000)
+	entries, err := decodePrincipals(bytes.NewReader(body), "users", 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1000 {
+		t.Fatalf("entries = %d, want 1000", len(entries))
+	}
+	for i, e := range entries {
+		if e.id != 10000+i {
+			t.Fatalf("entries[%d].id = %d, want %d", i, e.id, 10000+i)
+		}
+	}
+}
+
+func TestHttp_PrefetchSharedBody(t *testing.T) {
+	f := newFakeSTNS(t, map[string]string{
+		"/users":  string(syntheticUsers(2)),
+		"/groups": string(syntheticGroups(2, 2)),
+	})
+	h := newTestHttp(t, f, Config{})
+	if err := h.PrefetchUserGroups(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, byName, _ := h.Request("users", "name=user10000")
+	_, byID, _ := h.Request("users", "id=10000")
+	if &byName.Body[0] != &byID.Body[0] {
+		t.Error("name= and id= should share the body")
+	}
+	if string(byName.Body) != `[{"id":10000,"name":"user10000","group_id":10000,"directory":"/home/user10000","shell":"/bin/bash","keys":["ssh-ed25519 AAAA user10000"]}]` {
+		t.Errorf("body = %s", byName.Body)
+	}
+}
+
+func syntheticUsers(n int) []byte {
+	var b bytes.Buffer
+	b.WriteString("[")
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		id := 10000 + i
+		fmt.Fprintf(&b, `{"id":%d,"name":"user%d","group_id":%d,"directory":"/home/user%d","shell":"/bin/bash","keys":["ssh-ed25519 AAAA user%d"]}`,
+			id, id, id, id, id)
+	}
+	b.WriteString("]")
+	return b.Bytes()
+}
+
+// syntheticGroups returns n groups which have m users each, overlapping with the next groups.
+func syntheticGroups(n, m int) []byte {
+	var b bytes.Buffer
+	b.WriteString("[")
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		users := []string{}
+		for j := 0; j < m; j++ {
+			users = append(users, fmt.Sprintf(`"user%d"`, 10000+i+j))
+		}
+		fmt.Fprintf(&b, `{"id":%d,"name":"group%d","users":[%s]}`, 10000+i, 10000+i, strings.Join(users, ","))
+	}
+	b.WriteString("]")
+	return b.Bytes()
+}
+
+// reportPeakHeap runs fn while sampling the heap, and reports the highest bytes over the heap before it.
+func reportPeakHeap(b *testing.B, fn func()) {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	base := m.HeapAlloc
+	peak := base
+
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		t := time.NewTicker(time.Millisecond)
+		defer t.Stop()
+		for {
+			var m runtime.MemStats
+			runtime.ReadMemStats(&m)
+			if m.HeapAlloc > peak {
+				peak = m.HeapAlloc
+			}
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+		}
+	}()
+
+	fn()
+	close(done)
+	<-sampled
+	b.ReportMetric(float64(peak-base), "peak-heap-B")
+}
+
+func BenchmarkDecodePrincipals(b *testing.B) {
+	body := syntheticUsers(100000)
+	for _, workers := range []int{1, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.SetBytes(int64(len(body)))
+			b.ReportAllocs()
+			reportPeakHeap(b, func() {
+				for i := 0; i < b.N; i++ {
+					if _, err := decodePrincipals(bytes.NewReader(body), "users", workers); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkPrefetchUserGroups(b *testing.B) {
+	f := newFakeSTNS(b, nil)
+	f.lists["/users"] = syntheticUsers(100000)
+	f.lists["/groups"] = syntheticGroups(10000, 20)
+	h := newTestHttp(b, f, Config{})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	reportPeakHeap(b, func() {
+		for i := 0; i < b.N; i++ {
+			if err := h.PrefetchUserGroups(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
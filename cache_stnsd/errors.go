@@ -0,0 +1,78 @@
+package cache_stnsd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+)
+
+const (
+	ErrorCodeUpstreamTimeout  = "upstream_timeout"
+	ErrorCodeUpstreamDNS      = "upstream_dns_error"
+	ErrorCodeUpstreamError    = "upstream_error"
+	ErrorCodeNotFound         = "not_found"
+	ErrorCodeMethodNotAllowed = "method_not_allowed"
+	ErrorCodeQueryTooLong     = "query_too_long"
+	ErrorCodeInternal         = "internal_error"
+	ErrorCodeNotCached        = "not_cached"
+	ErrorCodeForbidden        = "forbidden"
+	ErrorCodeNoPending        = "no_pending_prefetch"
+)
+
+// Error is an error generated by cache-stnsd itself, returned as a JSON body.
+type Error struct {
+	StatusCode int    `json:"-"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	// Stale reports whether an expired cache entry was available for the request.
+	Stale bool `json:"stale"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func NewError(statusCode int, code, message string) *Error {
+	return &Error{
+		StatusCode: statusCode,
+		Code:       code,
+		Message:    message,
+	}
+}
+
+// upstreamError classifies an error of the request to upstream.
+func upstreamError(err error, stale bool) *Error {
+	e := NewError(http.StatusBadGateway, ErrorCodeUpstreamError, err.Error())
+	e.Stale = stale
+
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr) && !dnsErr.IsTimeout:
+		e.Code = ErrorCodeUpstreamDNS
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		e.StatusCode = http.StatusGatewayTimeout
+		e.Code = ErrorCodeUpstreamTimeout
+	}
+	return e
+}
+
+// AsError returns err as *Error. Unknown errors are internal errors.
+func AsError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return NewError(http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+}
+
+// WriteError writes the error as a JSON body.
+func WriteError(w http.ResponseWriter, e *Error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.StatusCode)
+	json.NewEncoder(w).Encode(e)
+}
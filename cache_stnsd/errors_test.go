@@ -0,0 +1,77 @@
+package cache_stnsd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func Test_upstreamError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			name:       "dns",
+			err:        &url.Error{Op: "Get", URL: "http://stns", Err: &net.DNSError{Err: "no such host", Name: "stns"}},
+			wantStatus: http.StatusBadGateway,
+			wantCode:   ErrorCodeUpstreamDNS,
+		},
+		{
+			name:       "timeout",
+			err:        &url.Error{Op: "Get", URL: "http://stns", Err: timeoutError{}},
+			wantStatus: http.StatusGatewayTimeout,
+			wantCode:   ErrorCodeUpstreamTimeout,
+		},
+		{
+			name:       "query wrapper timeout",
+			err:        fmt.Errorf("query wrapper timeout: %w", context.DeadlineExceeded),
+			wantStatus: http.StatusGatewayTimeout,
+			wantCode:   ErrorCodeUpstreamTimeout,
+		},
+		{
+			name:       "refused",
+			err:        errors.New("connection refused"),
+			wantStatus: http.StatusBadGateway,
+			wantCode:   ErrorCodeUpstreamError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := upstreamError(tt.err, true)
+			if got.StatusCode != tt.wantStatus || got.Code != tt.wantCode || !got.Stale {
+				t.Errorf("upstreamError() = %+v, want %d %s", got, tt.wantStatus, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	w := httptest.NewRecorder()
+	WriteError(w, AsError(NewError(http.StatusNotFound, ErrorCodeNotFound, "not found")))
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", w.Code)
+	}
+	want := "{\"code\":\"not_found\",\"message\":\"not found\",\"stale\":false}\n"
+	if w.Body.String() != want {
+		t.Errorf("body = %s, want %s", w.Body.String(), want)
+	}
+
+	if AsError(errors.New("unknown")).StatusCode != http.StatusInternalServerError {
+		t.Error("unknown error should be an internal error")
+	}
+}
@@ -0,0 +1,124 @@
+package cache_stnsd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/ReneKroon/ttlcache/v2"
+)
+
+// fakeSTNS is an upstream serving the lists of users, groups and other paths for the prefetch tests.
+// The lists can be changed while it is running.
+type fakeSTNS struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	lists  map[string][]byte
+	status map[string]int
+	header http.Header
+	// lookup is the response to the requests with a query
+	lookupStatus int
+	lookupBody   string
+	lookups      int
+}
+
+// newFakeSTNS starts a fake STNS with the lists by path such as "/users".
+// A path without a list returns an empty list, and a lookup returns 404.
+func newFakeSTNS(t testing.TB, lists map[string]string) *fakeSTNS {
+	f := &fakeSTNS{
+		lists:        map[string][]byte{},
+		status:       map[string]int{},
+		header:       http.Header{},
+		lookupStatus: http.StatusNotFound,
+		lookupBody:   `{}`,
+	}
+	for p, body := range lists {
+		f.lists[p] = []byte(body)
+	}
+
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		for k, v := range f.header {
+			w.Header()[k] = v
+		}
+
+		if r.URL.RawQuery != "" {
+			f.lookups++
+			w.WriteHeader(f.lookupStatus)
+			w.Write([]byte(f.lookupBody))
+			return
+		}
+
+		if code, ok := f.status[r.URL.Path]; ok {
+			w.WriteHeader(code)
+		}
+		if body, ok := f.lists[r.URL.Path]; ok {
+			w.Write(body)
+			return
+		}
+		w.Write([]byte(`[]`))
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeSTNS) setList(path, body string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lists[path] = []byte(body)
+}
+
+func (f *fakeSTNS) setStatus(path string, code int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status[path] = code
+}
+
+func (f *fakeSTNS) setHeader(key, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.header.Set(key, value)
+}
+
+func (f *fakeSTNS) setLookup(code int, body string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lookupStatus = code
+	f.lookupBody = body
+}
+
+// lookupCount returns the number of the requests with a query, and resets it.
+func (f *fakeSTNS) lookupCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := f.lookups
+	f.lookups = 0
+	return n
+}
+
+// newTestHttp returns Http with a new cache for the config.
+// api_endpoint is the fake STNS, cache is enabled, and cache_ttl is 600 unless it is set.
+func newTestHttp(t testing.TB, f *fakeSTNS, config Config) *Http {
+	config.ApiEndpoint = f.URL
+	config.Cache = true
+	if config.CacheTTL == 0 {
+		config.CacheTTL = 600
+	}
+
+	c := ttlcache.NewCache()
+	t.Cleanup(func() { c.Close() })
+	h, err := NewHttp(&config, c, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// isCached reports whether the lookup is in the cache.
+func isCached(h *Http, resource, query string) bool {
+	key, _ := h.cacheKey(resource, query)
+	return h.hasCache(key)
+}
@@ -0,0 +1,194 @@
+package cache_stnsd
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/STNS/STNS/v2/model"
+	"github.com/sirupsen/logrus"
+)
+
+// generation is a complete set of users and groups built by a prefetch.
+// It is swapped into the cache at once, so clients never see a mix of two prefetches.
+type generation struct {
+	entries map[string]cacheEntry
+	// directories are the resources whose full list is prefetched
+	directories map[string]directory
+	// memberships is the reverse index from a user name to its groups
+	memberships map[string][]*model.Group
+	// principals are the ids of users and groups by name for each resource
+	principals map[string]map[string]int
+	// idRanges are the highest and the lowest id of users and groups
+	idRanges map[string]idRange
+}
+
+func newGeneration() *generation {
+	return &generation{
+		entries:     map[string]cacheEntry{},
+		directories: map[string]directory{},
+		principals:  map[string]map[string]int{},
+		idRanges:    map[string]idRange{},
+	}
+}
+
+func (g *generation) addPrincipal(resource, name string, id int) {
+	if g.principals[resource] == nil {
+		g.principals[resource] = map[string]int{}
+	}
+	g.principals[resource][name] = id
+}
+
+// expired returns a copy of the generation whose lists are not fresh.
+func (g *generation) expired() *generation {
+	c := *g
+	c.directories = map[string]directory{}
+	return &c
+}
+
+// keep copies the list of the resource and its lookups from the previous generation,
+// when the resource fails to be fetched. Expired entries are not copied.
+func (g *generation) keep(prev *generation, resource string, now time.Time) int {
+	d, ok := prev.fresh(resource, now)
+	if !ok {
+		return 0
+	}
+
+	kept := 0
+	for k, e := range prev.entries {
+		if k != d.Key && !strings.HasPrefix(k, d.Key+"?") {
+			continue
+		}
+		if e.StoredAt.Add(e.TTL).Before(now) {
+			continue
+		}
+		g.entries[k] = e
+		kept++
+	}
+	g.directories[resource] = d
+	return kept
+}
+
+// principal is a user or a group.
+type principal struct {
+	resource string
+	name     string
+	id       int
+}
+
+// deletedPrincipals returns the users and groups of the previous generation missing in the new one.
+// Resources not fetched by the new generation are not compared.
+func deletedPrincipals(prev, gen *generation) []principal {
+	deleted := []principal{}
+	if prev == nil {
+		return deleted
+	}
+	for resource, names := range prev.principals {
+		if _, ok := gen.directories[resource]; !ok {
+			continue
+		}
+		for name, id := range names {
+			if _, ok := gen.principals[resource][name]; !ok {
+				deleted = append(deleted, principal{resource: resource, name: name, id: id})
+			}
+		}
+	}
+	return deleted
+}
+
+func (g *generation) set(key string, res Response, storedAt time.Time, ttl time.Duration) {
+	g.entries[key] = cacheEntry{
+		Response: res,
+		StoredAt: storedAt,
+		TTL:      ttl,
+	}
+}
+
+// fresh returns the prefetched list of the resource if it has not expired yet.
+func (g *generation) fresh(resource string, now time.Time) (directory, bool) {
+	if g == nil {
+		return directory{}, false
+	}
+	d, ok := g.directories[resource]
+	if !ok || d.remaining(now) <= 0 {
+		return directory{}, false
+	}
+	return d, true
+}
+
+// purgeLookups removes the lookups by name or id cached on demand
+// which are missing in the lists of the new generation.
+// Entries stored after the list was fetched are kept, because they may be added after that.
+func (h *Http) purgeLookups(gen *generation) int {
+	removed := 0
+	for k, v := range h.cache.GetItems() {
+		e, ok := v.(cacheEntry)
+		if !ok || e.Response.StatusCode != http.StatusOK {
+			continue
+		}
+		if _, ok := gen.entries[k]; ok {
+			continue
+		}
+
+		for resource, d := range gen.directories {
+			query, ok := strings.CutPrefix(k, d.Key+"?")
+			if !ok || !e.StoredAt.Before(d.StoredAt) {
+				continue
+			}
+			if _, ok := lookupResource(resource, query); !ok {
+				continue
+			}
+
+			logrus.Infof("prefetch: remove %s which is not in %s", k, resource)
+			h.cache.Remove(k)
+			removed++
+		}
+	}
+	return removed
+}
+
+// currentGeneration returns the last swapped generation. It is not modified after the swap.
+func (h *Http) currentGeneration() *generation {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.generation
+}
+
+// swapGeneration writes the new generation into the cache and removes the keys
+// of the previous generation which are not in the new one, while readers are blocked.
+// It clears the refused prefetch.
+func (h *Http) swapGeneration(gen *generation) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	for k, e := range gen.entries {
+		// the entries kept from the previous generation expire as before,
+		// and an expired one is not set, because ttlcache never expires a ttl of 0 or less
+		remaining := e.StoredAt.Add(e.TTL).Sub(now)
+		if remaining <= 0 {
+			delete(gen.entries, k)
+			h.cache.Remove(k)
+			continue
+		}
+		h.cache.SetWithTTL(k, e, remaining)
+	}
+
+	for _, p := range deletedPrincipals(h.generation, gen) {
+		logrus.Infof("prefetch: %s name=%s id=%d was deleted in upstream", p.resource, p.name, p.id)
+	}
+
+	removed := 0
+	if h.generation != nil {
+		for k := range h.generation.entries {
+			if _, ok := gen.entries[k]; !ok {
+				h.cache.Remove(k)
+				removed++
+			}
+		}
+	}
+	removed += h.purgeLookups(gen)
+	h.generation = gen
+	h.guard = nil
+	logrus.Infof("prefetch: swapped generation entries:%d removed:%d", len(gen.entries), removed)
+}
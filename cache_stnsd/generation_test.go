@@ -0,0 +1,131 @@
+package cache_stnsd
+
+import (
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHttp_PrefetchGeneration(t *testing.T) {
+	f := newFakeSTNS(t, map[string]string{
+		"/users":  `[{"id":1000,"name":"alice"},{"id":1001,"name":"bob"}]`,
+		"/groups": `[{"id":1000,"name":"alice"}]`,
+	})
+	h := newTestHttp(t, f, Config{RequestRetry: 1})
+
+	h.PrefetchUserGroups()
+	for _, q := range []string{"name=alice", "id=1000", "name=bob", "id=1001"} {
+		if !isCached(h, "users", q) {
+			t.Errorf("users?%s should be cached", q)
+		}
+	}
+
+	// bob is deleted, but the groups are unavailable
+	f.setList("/users", `[{"id":1000,"name":"alice"}]`)
+	f.setStatus("/groups", http.StatusInternalServerError)
+
+	h.PrefetchUserGroups()
+	if !isCached(h, "users", "name=bob") {
+		t.Error("previous generation should be kept when the prefetch fails")
+	}
+
+	// the users are not cacheable
+	f.setStatus("/groups", http.StatusOK)
+	f.setHeader("Cache-Control", "no-store")
+
+	if err := h.PrefetchUserGroups(); err == nil {
+		t.Error("prefetch of an uncacheable list should fail")
+	}
+	if !isCached(h, "users", "name=bob") || !isCached(h, "users", "name=alice") {
+		t.Error("previous generation should be kept when the list is not cacheable")
+	}
+
+	f.setHeader("Cache-Control", "max-age=600")
+
+	h.PrefetchUserGroups()
+	for q, want := range map[string]bool{"name=alice": true, "id=1000": true, "name=bob": false, "id=1001": false} {
+		if isCached(h, "users", q) != want {
+			t.Errorf("users?%s cached = %v, want %v", q, !want, want)
+		}
+	}
+}
+
+func TestHttp_PrefetchConcurrentRead(t *testing.T) {
+	f := newFakeSTNS(t, map[string]string{
+		"/users":  `[{"id":1000,"name":"alice"}]`,
+		"/groups": `[{"id":1000,"name":"alice","users":["alice"]}]`,
+	})
+	h := newTestHttp(t, f, Config{Cached: Cached{Prefetch: true, Authoritative: true}})
+	h.PrefetchUserGroups()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				isCache, _, err := h.Request("users", "name=alice")
+				if err != nil || !isCache {
+					t.Errorf("users?name=alice should be cached: %v", err)
+					return
+				}
+				h.Request("groups", "member=alice")
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		h.PrefetchUserGroups()
+	}
+	wg.Wait()
+}
+
+func TestHttp_PrefetchPurgesDeleted(t *testing.T) {
+	f := newFakeSTNS(t, map[string]string{
+		"/users": `[{"id":1000,"name":"alice"}]`,
+	})
+	// deleted users are still found until upstream catches up
+	f.setLookup(http.StatusOK, `[{"id":1001,"name":"bob"}]`)
+	h := newTestHttp(t, f, Config{NegativeCacheTTL: 600})
+
+	for _, q := range []string{"name=bob", "id=1001"} {
+		if _, _, err := h.Request("users", q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	status, _ := h.cacheKey("status", "")
+	h.setCache(status, Response{StatusCode: http.StatusOK}, time.Minute)
+
+	h.PrefetchUserGroups()
+
+	for q, want := range map[string]bool{"name=alice": true, "name=bob": false, "id=1001": false} {
+		if isCached(h, "users", q) != want {
+			t.Errorf("users?%s cached = %v, want %v", q, !want, want)
+		}
+	}
+	if !h.hasCache(status) {
+		t.Error("entries other than lookups should be kept")
+	}
+}
+
+func Test_deletedPrincipals(t *testing.T) {
+	prev := newGeneration()
+	prev.addPrincipal("users", "alice", 1000)
+	prev.addPrincipal("users", "bob", 1001)
+	prev.addPrincipal("groups", "dev", 2000)
+
+	gen := newGeneration()
+	gen.directories["users"] = directory{}
+	gen.addPrincipal("users", "alice", 1000)
+
+	got := deletedPrincipals(prev, gen)
+	want := []principal{{resource: "users", name: "bob", id: 1001}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("deletedPrincipals() = %v, want %v", got, want)
+	}
+
+	if got := deletedPrincipals(nil, gen); len(got) != 0 {
+		t.Errorf("deletedPrincipals() without the previous generation = %v", got)
+	}
+}
@@ -0,0 +1,97 @@
+package cache_stnsd
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// PrefetchGuard is the state of a prefetch refused because it deletes too many users or groups.
+type PrefetchGuard struct {
+	Since time.Time `json:"since"`
+	// Deleted is the number of deleted users and groups by resource.
+	Deleted map[string]int `json:"deleted"`
+	// Previous is the number of users and groups of the applied prefetch by resource.
+	Previous map[string]int `json:"previous"`
+	Reason   string         `json:"reason"`
+}
+
+// checkDeletions returns an error when the new generation deletes more principals than allowed.
+func checkDeletions(prev, gen *generation, cached Cached) (map[string]int, map[string]int, error) {
+	deleted := map[string]int{}
+	for _, p := range deletedPrincipals(prev, gen) {
+		deleted[p.resource]++
+	}
+
+	previous := map[string]int{}
+	var err error
+	for resource, n := range deleted {
+		previous[resource] = len(prev.principals[resource])
+		if cached.MaxDeletions > 0 && n > cached.MaxDeletions {
+			err = fmt.Errorf("%d %s are deleted, more than max_deletions %d", n, resource, cached.MaxDeletions)
+		} else if cached.MaxDeletionPercent > 0 && n*100 > previous[resource]*cached.MaxDeletionPercent {
+			err = fmt.Errorf("%d of %d %s are deleted, more than max_deletion_percent %d%%", n, previous[resource], resource, cached.MaxDeletionPercent)
+		}
+	}
+	return deleted, previous, err
+}
+
+// guardPrefetch refuses the new generation when it deletes too many principals.
+// The previous generation is kept in the cache until the admin applies a prefetch.
+func (h *Http) guardPrefetch(gen *generation) bool {
+	config := h.Config()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	deleted, previous, err := checkDeletions(h.generation, gen, config.Cached)
+	if err == nil {
+		h.guard = nil
+		return false
+	}
+
+	logrus.Errorf("prefetch: REFUSED, keep the previous users and groups until it is applied by the admin: %s", err)
+	since := time.Now()
+	if h.guard != nil {
+		since = h.guard.Since
+	}
+	h.guard = &PrefetchGuard{
+		Since:    since,
+		Deleted:  deleted,
+		Previous: previous,
+		Reason:   err.Error(),
+	}
+
+	// keep the previous entries until the admin decides, served as stale
+	for k, e := range h.generation.entries {
+		h.cache.SetWithTTL(k, e, time.Duration(config.CacheTTL)*time.Second)
+	}
+	return true
+}
+
+// PrefetchGuard returns the refused prefetch, or nil if the last prefetch was applied.
+func (h *Http) PrefetchGuard() *PrefetchGuard {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.guard == nil {
+		return nil
+	}
+	g := *h.guard
+	return &g
+}
+
+// ApplyPendingPrefetch applies the prefetch refused by the guard.
+// Upstream is fetched again and swapped in without the guard, so the refused data which may be stale is not applied.
+func (h *Http) ApplyPendingPrefetch() error {
+	guard := h.PrefetchGuard()
+	if guard == nil {
+		return NewError(http.StatusConflict, ErrorCodeNoPending, "no prefetch is pending")
+	}
+
+	logrus.Warnf("prefetch: apply the refused prefetch by the admin: %s", guard.Reason)
+	if err := h.prefetch(true); err != nil {
+		return upstreamError(err, false)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package cache_stnsd
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func Test_checkDeletions(t *testing.T) {
+	prev := newGeneration()
+	for i, name := range []string{"a", "b", "c", "d"} {
+		prev.addPrincipal("users", name, i)
+	}
+
+	tests := []struct {
+		name    string
+		keep    []string
+		cached  Cached
+		wantErr bool
+	}{
+		{"no deletion", []string{"a", "b", "c", "d"}, Cached{MaxDeletions: 1, MaxDeletionPercent: 1}, false},
+		{"within percent", []string{"a", "b"}, Cached{MaxDeletionPercent: 50}, false},
+		{"over percent", []string{"a"}, Cached{MaxDeletionPercent: 50}, true},
+		{"empty list", []string{}, Cached{MaxDeletionPercent: 50}, true},
+		{"over number", []string{"a", "b"}, Cached{MaxDeletions: 1}, true},
+		{"unlimited", []string{}, Cached{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gen := newGeneration()
+			gen.directories["users"] = directory{}
+			for i, name := range tt.keep {
+				gen.addPrincipal("users", name, i)
+			}
+			deleted, previous, err := checkDeletions(prev, gen, tt.cached)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkDeletions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if n := 4 - len(tt.keep); deleted["users"] != n || (n > 0 && previous["users"] != 4) {
+				t.Errorf("checkDeletions() = %v, %v", deleted, previous)
+			}
+		})
+	}
+}
+
+func TestHttp_PrefetchGuard(t *testing.T) {
+	f := newFakeSTNS(t, map[string]string{
+		"/users": `[{"id":1000,"name":"alice"},{"id":1001,"name":"bob"}]`,
+	})
+	h := newTestHttp(t, f, Config{Cached: Cached{MaxDeletionPercent: 50}})
+
+	h.PrefetchUserGroups()
+	if err := h.ApplyPendingPrefetch(); err == nil {
+		t.Error("nothing should be pending")
+	}
+
+	// upstream returns an empty list by mistake
+	f.setList("/users", `[]`)
+
+	h.PrefetchUserGroups()
+	guard := h.PrefetchGuard()
+	if guard == nil {
+		t.Fatal("prefetch should be refused")
+	}
+	if guard.Deleted["users"] != 2 || guard.Previous["users"] != 2 {
+		t.Errorf("guard = %+v", guard)
+	}
+	if !isCached(h, "users", "name=alice") || !isCached(h, "users", "name=bob") {
+		t.Error("previous users should be kept")
+	}
+
+	// the apply fails with upstream, and the refusal is kept
+	f.setStatus("/users", http.StatusInternalServerError)
+	if err := h.ApplyPendingPrefetch(); err == nil || AsError(err).StatusCode != http.StatusBadGateway {
+		t.Errorf("apply with upstream error = %v", err)
+	}
+	if h.PrefetchGuard() == nil {
+		t.Error("guard should be kept when the apply fails")
+	}
+
+	// the apply fetches upstream again instead of the refused list
+	f.setStatus("/users", http.StatusOK)
+	f.setList("/users", `[{"id":1002,"name":"carol"}]`)
+	if err := h.ApplyPendingPrefetch(); err != nil {
+		t.Fatal(err)
+	}
+	if h.PrefetchGuard() != nil {
+		t.Error("guard should be cleared")
+	}
+	if isCached(h, "users", "name=alice") || isCached(h, "users", "name=bob") {
+		t.Error("applied prefetch should delete users")
+	}
+	if !isCached(h, "users", "name=carol") {
+		t.Error("applied prefetch should be fetched again")
+	}
+}
+
+func TestHttp_swapGenerationExpired(t *testing.T) {
+	h := newTestHttp(t, newFakeSTNS(t, nil), Config{})
+	key, _ := h.cacheKey("users", "name=alice")
+	h.setCache(key, Response{StatusCode: http.StatusOK}, time.Minute)
+
+	// applied after its ttl, ttlcache never expires a ttl of 0 or less
+	gen := newGeneration()
+	gen.set(key, Response{StatusCode: http.StatusOK}, time.Now().Add(-2*time.Minute), time.Minute)
+	h.swapGeneration(gen)
+
+	if h.hasCache(key) {
+		t.Error("expired entry should not be set")
+	}
+	if _, ok := h.currentGeneration().entries[key]; ok {
+		t.Error("expired entry should not be in the generation")
+	}
+}
+
+func TestHttp_PrefetchGuardReload(t *testing.T) {
+	f := newFakeSTNS(t, map[string]string{
+		"/users": `[{"id":1000,"name":"alice"},{"id":1001,"name":"bob"}]`,
+	})
+	config := Config{Cached: Cached{Prefetch: true, Authoritative: true, MaxDeletionPercent: 50}}
+	h := newTestHttp(t, f, config)
+
+	h.PrefetchUserGroups()
+	f.setList("/users", `[]`)
+	h.PrefetchUserGroups()
+	if h.PrefetchGuard() == nil {
+		t.Fatal("prefetch should be refused")
+	}
+
+	tests := []struct {
+		name     string
+		endpoint string
+	}{
+		{"same upstream", f.URL},
+		{"another upstream", newFakeSTNS(t, nil).URL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reloaded := config
+			reloaded.ApiEndpoint = tt.endpoint
+			reloaded.Cache = true
+			reloaded.CacheTTL = 600
+			if err := h.Reload(&reloaded); err != nil {
+				t.Fatal(err)
+			}
+			if h.PrefetchGuard() == nil {
+				t.Error("guard should be kept by reload")
+			}
+
+			h.PrefetchUserGroups()
+			if h.PrefetchGuard() == nil {
+				t.Error("prefetch after reload should be refused")
+			}
+		})
+	}
+
+	// the previous users are kept under the first upstream
+	h.Reload(&Config{ApiEndpoint: f.URL, Cache: true, CacheTTL: 600, Cached: config.Cached})
+	if !isCached(h, "users", "name=alice") {
+		t.Error("previous users should be kept")
+	}
+	if status, _, _ := h.RequestWithCacheControl("users", "name=carol", RequestCacheControl{}); status.Detail == "authoritative" {
+		t.Error("lists before the reload should not be authoritative")
+	}
+}
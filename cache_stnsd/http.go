@@ -1,28 +1,37 @@
 package cache_stnsd
 
 import (
-	"encoding/json"
+	"bytes"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"path"
-	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ReneKroon/ttlcache/v2"
 	"github.com/STNS/STNS/v2/model"
-	"github.com/STNS/libstns-go/libstns"
 	"github.com/sirupsen/logrus"
 )
 
 type Http struct {
+	mu      sync.RWMutex
 	config  *Config
 	cache   *ttlcache.Cache
-	client  *libstns.STNS
+	client  upstream
 	version string
+	// generation is the last prefetched users and groups
+	generation *generation
+	// guard is set while a prefetch is refused
+	guard *PrefetchGuard
+	// warming is true until the first prefetch at startup
+	warming atomic.Bool
 }
 
-func SetExpirationCallback(client *libstns.STNS, cache *ttlcache.Cache) {
+func SetExpirationCallback(client upstream, cache *ttlcache.Cache) {
 	cache.SetCheckExpirationCallback(
 		func(key string, value interface{}) bool {
 			res, err := client.Request("status", "")
@@ -36,22 +45,11 @@ func SetExpirationCallback(client *libstns.STNS, cache *ttlcache.Cache) {
 
 }
 func NewHttp(config *Config, cache *ttlcache.Cache, version string) (*Http, error) {
-	client, err := libstns.NewSTNS(config.ApiEndpoint, &libstns.Options{
-		AuthToken:      config.AuthToken,
-		User:           config.User,
-		Password:       config.Password,
-		SkipSSLVerify:  config.SSLVerify,
-		HttpProxy:      config.HttpProxy,
-		HttpKeepalive:  config.HttpKeepalive,
-		RequestTimeout: config.RequestTimeout,
-		RequestRetry:   config.RequestRetry,
-		HttpHeaders:    config.HttpHeaders,
-		TLS:            config.TLS,
-	})
-	SetExpirationCallback(client, cache)
+	client, err := newUpstream(config, version)
 	if err != nil {
 		return nil, err
 	}
+	SetExpirationCallback(client, cache)
 
 	return &Http{
 		config:  config,
@@ -61,148 +59,339 @@ func NewHttp(config *Config, cache *ttlcache.Cache, version string) (*Http, erro
 	}, nil
 }
 
-func (h *Http) Request(path, query string) (bool, *libstns.Response, error) {
+// Reload swaps the config and the upstream client in place.
+// The cache entries are kept as they are.
+func (h *Http) Reload(config *Config) error {
+	client, err := newUpstream(config, h.version)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// the previous users and groups are kept for the deletion guard of the next prefetch
+	if h.generation != nil && config.ApiEndpoint != h.config.ApiEndpoint {
+		// the lookups of the new upstream are not cached yet
+		h.generation = h.generation.expired()
+	}
+	h.config = config
+	h.client = client
+	h.cache.SetTTL(time.Duration(config.CacheTTL) * time.Second)
+	SetExpirationCallback(client, h.cache)
+	return nil
+}
+
+// Version returns the version of cache-stnsd.
+func (h *Http) Version() string {
+	return h.version
+}
+
+// SetWarming sets whether the cache is being warmed up at startup.
+func (h *Http) SetWarming(warming bool) {
+	h.warming.Store(warming)
+}
+
+// Warming reports whether the cache is being warmed up at startup.
+func (h *Http) Warming() bool {
+	return h.warming.Load()
+}
+
+// Config returns the config currently in use.
+func (h *Http) Config() *Config {
+	config, _ := h.current()
+	return config
+}
+
+func (h *Http) current() (*Config, upstream) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.config, h.client
+}
+
+func newUpstream(config *Config, version string) (upstream, error) {
+	if config.QueryWrapper != "" {
+		return NewQueryWrapper(config.QueryWrapper, config.RequestTimeout), nil
+	}
+
+	opt, err := upstreamOptions(config, version)
+	if err != nil {
+		return nil, err
+	}
+
+	if isUnixEndpoint(config.ApiEndpoint) {
+		return NewChain(config.ApiEndpoint, opt)
+	}
+	return NewHTTPUpstream(config.ApiEndpoint, opt)
+}
+
+// cacheEntry is a response stored in the cache with the time it was stored.
+type cacheEntry struct {
+	Response Response
+	StoredAt time.Time
+	TTL      time.Duration
+}
+
+func (h *Http) setCache(key string, res Response, ttl time.Duration) {
+	h.cache.SetWithTTL(key, cacheEntry{
+		Response: res,
+		StoredAt: time.Now(),
+		TTL:      ttl,
+	}, ttl)
+}
+
+func (h *Http) Request(path, query string) (bool, *Response, error) {
+	status, res, err := h.RequestWithCacheControl(path, query, RequestCacheControl{})
+	return status.Hit, res, err
+}
+
+// RequestWithCacheControl is Request with the cache directives of the client.
+// It returns how the request was answered with the response.
+func (h *Http) RequestWithCacheControl(path, query string, cc RequestCacheControl) (CacheStatus, *Response, error) {
+	config, client := h.current()
 	cacheKey, err := h.cacheKey(path, query)
 	if err != nil {
-		return false, nil, err
+		return CacheStatus{}, nil, err
+	}
+
+	if name, ok := membershipUser(path, query); ok {
+		logrus.Debugf("response from the groups:%s", cacheKey)
+		return h.membershipRequest(name, cacheKey, cc)
 	}
-	if h.config.Cache {
+
+	status := CacheStatus{Key: cacheKey, Fwd: "miss"}
+	switch {
+	case !config.Cache:
+		status.Fwd = "bypass"
+	case cc.NoCache:
+		status.Fwd = "request"
+	default:
+		// don't read while a prefetch generation is being swapped
+		h.mu.RLock()
 		body, err := h.cache.Get(cacheKey)
+		h.mu.RUnlock()
 		if err == nil {
 			switch v := body.(type) {
-			case libstns.Response:
+			case cacheEntry:
+				age := time.Since(v.StoredAt)
+				if cc.MaxAge > 0 && age > cc.MaxAge {
+					logrus.Debugf("cache is older than max-age:%s", cacheKey)
+					status.Fwd = "stale"
+					break
+				}
 				logrus.Debugf("response from cache:%s", cacheKey)
-				return true, &v, nil
+				status = CacheStatus{Hit: true, TTL: v.TTL - age, Age: age, Key: cacheKey}
+				if status.Stale() {
+					// kept by the expiration callback while upstream is down
+					status.Detail = "fallback"
+				}
+				return status, &v.Response, nil
 			}
 		}
 	}
+
+	if status.Fwd == "miss" && config.Cached.Authoritative {
+		if res, d, ok := h.authoritativeNotFound(path, query); ok {
+			logrus.Debugf("not found in the prefetched list:%s", cacheKey)
+			age := time.Since(d.StoredAt)
+			return CacheStatus{Hit: true, TTL: d.TTL - age, Age: age, Key: cacheKey, Detail: "authoritative"}, res, nil
+		}
+	}
+
+	if cc.OnlyIfCached {
+		status.Fwd = ""
+		status.Detail = ErrorCodeNotCached
+		return status, nil, NewError(http.StatusGatewayTimeout, ErrorCodeNotCached,
+			fmt.Sprintf("%s?%s is not cached", path, query))
+	}
 	logrus.Debugf("send request to stns:%s/%s cache:%s", path, query, cacheKey)
-	res, err := h.client.Request(path, query)
+	res, err := client.Request(path, query)
 	if err != nil && res == nil {
 		logrus.Errorf("make http request error:%s", err.Error())
-		return false, nil, err
+		e := upstreamError(err, config.Cache && h.hasCache(cacheKey))
+		status.Detail = e.Code
+		return status, nil, e
 	}
+	status.FwdStatus = res.StatusCode
 
 	logrus.Infof("request to stns:%s/%s status:%d", path, query, res.StatusCode)
+	if v := res.Header.Get(UpstreamCacheHeader); v != "" {
+		logrus.Debugf("response from upstream cache-stnsd:%s/%s cache:%s", path, query, v)
+	}
+
+	var defaultTTL time.Duration
 	switch res.StatusCode {
 	case http.StatusOK:
-		if h.config.Cache {
-			h.cache.Set(cacheKey, *res)
-		}
-
-		return false, res, nil
+		defaultTTL = time.Duration(config.CacheTTL) * time.Second
 	case http.StatusNotFound:
-		if h.config.Cache {
-			h.cache.SetWithTTL(cacheKey, *res, time.Duration(h.config.NegativeCacheTTL)*time.Second)
-		}
-		return false, res, nil
+		defaultTTL = time.Duration(config.NegativeCacheTTL) * time.Second
 	default:
-		return false, res, nil
+		return status, res, nil
+	}
+
+	if config.Cache {
+		if ttl, ok := responseTTL(res.Header, defaultTTL, config.Cached, time.Now()); ok {
+			h.setCache(cacheKey, *res, ttl)
+			status.Stored = true
+			status.TTL = ttl
+		}
 	}
+	return status, res, nil
+}
+
+func (h *Http) hasCache(cacheKey string) bool {
+	_, err := h.cache.Get(cacheKey)
+	return err == nil
+}
+
+func (h *Http) prefetchUserOrGroup(resource string, gen *generation) error {
+	return h.prefetchList(resource, gen, func(r io.Reader) ([]principalEntry, error) {
+		return decodePrincipals(r, resource, runtime.GOMAXPROCS(0))
+	})
+}
+
+// prefetchPath prefetches a path of prefetch_paths, indexed by the fields.
+func (h *Http) prefetchPath(p PrefetchPath, gen *generation) error {
+	resource := p.Resource()
+	return h.prefetchList(resource, gen, func(r io.Reader) ([]principalEntry, error) {
+		return decodeIndexed(r, resource, p.Index, runtime.GOMAXPROCS(0))
+	})
 }
 
-func (h *Http) prefetchUserOrGroup(resource string, ug interface{}) error {
-	resp, err := h.client.Request(resource, "")
+// prefetchList adds the list of the resource and the lookups of its items to the generation.
+func (h *Http) prefetchList(resource string, gen *generation, decode func(io.Reader) ([]principalEntry, error)) error {
+	config, client := h.current()
+	ttl := time.Duration(config.CacheTTL) * time.Second
+	resp, body, err := requestStream(client, resource, "")
 	if err != nil && resp == nil {
 		return err
 	}
 	logrus.Infof("prefetch: request to stns:%s status:%d", resource, resp.StatusCode)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		defer body.Close()
+	}
 	if resp.StatusCode == http.StatusOK {
-		cacheKey, err := h.cacheKey(resource, "")
+		now := time.Now()
+		ttl, ok := responseTTL(resp.Header, ttl, config.Cached, now)
+		if !ok {
+			// the swap would remove every entry of the previous generation
+			return fmt.Errorf("prefetch: %s is not cacheable", resource)
+		}
+
+		listKey, err := h.cacheKey(resource, "")
 		if err != nil {
 			return err
 		}
 
-		logrus.Debugf("prefetch: set cache key:%s", cacheKey)
-		h.cache.Set(cacheKey, *resp)
+		// the list is decoded while it is read, and the read bytes are kept as the body of the list
+		var list bytes.Buffer
+		tee := io.TeeReader(body, &list)
+		entries, err := decode(tee)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(io.Discard, tee); err != nil {
+			return err
+		}
+		resp.Body = list.Bytes()
 
-		userGroups := []model.UserGroup{}
+		// the entries are not modified, so they share the header
+		header := resp.Header.Clone()
+		if resource == "users" || resource == "groups" {
+			r := newIDRange(entries)
+			r.setHeader(header, resource)
+			gen.idRanges[resource] = r
+		}
 
-		switch v := ug.(type) {
-		case []*model.User:
-			if err := json.Unmarshal(resp.Body, &v); err != nil {
-				return err
-			}
+		logrus.Debugf("prefetch: set cache key:%s", listKey)
+		gen.set(listKey, Response{StatusCode: resp.StatusCode, Header: header, Body: resp.Body}, now, ttl)
+		groups := []*model.Group{}
 
-			for _, u := range v {
-				userGroups = append(userGroups, u)
-			}
-		case []*model.Group:
-			if err := json.Unmarshal(resp.Body, &v); err != nil {
-				return err
-			}
-			for _, u := range v {
-				userGroups = append(userGroups, u)
+		logrus.Infof("write cache for %s count:%d", resource, len(entries))
+		for _, e := range entries {
+			if resource == "users" || resource == "groups" {
+				gen.addPrincipal(resource, e.name, e.id)
 			}
-		default:
-			return fmt.Errorf("unknown type: %v", reflect.TypeOf(ug))
-		}
-
-		logrus.Infof("write cache for %s count:%d", resource, len(userGroups))
-		for _, val := range userGroups {
-			j, err := json.Marshal(val)
-			if err != nil {
-				return err
+			if e.group != nil {
+				groups = append(groups, e.group)
 			}
 
-			j = append([]byte(`[`), j...)
-			j = append(j, []byte(`]`)...)
-
-			cacheKey, err := h.cacheKey(resource, fmt.Sprintf("name=%s", val.GetName()))
-			if err != nil {
-				return err
+			res := Response{
+				StatusCode: http.StatusOK,
+				Body:       e.body,
+				Header:     header,
 			}
-
-			logrus.Debugf("prefetch: set cache key:%s", cacheKey)
-			h.cache.Set(cacheKey,
-				libstns.Response{
-					StatusCode: http.StatusOK,
-					Body:       j,
-					Headers:    resp.Headers,
-				},
-			)
-
-			cacheKey, err = h.cacheKey(resource, fmt.Sprintf("id=%d", val.GetID()))
-			if err != nil {
-				return err
+			for _, q := range e.queries {
+				gen.set(listKey+"?"+q, res, now, ttl)
 			}
+		}
 
-			logrus.Debugf("prefetch: set cache key:%s", cacheKey)
-			h.cache.Set(cacheKey,
-				libstns.Response{
-					StatusCode: http.StatusOK,
-					Body:       j,
-					Headers:    resp.Headers,
-				},
-			)
+		if resource == "groups" {
+			gen.memberships = buildMemberships(groups)
 		}
+		gen.directories[resource] = directory{Key: listKey, StoredAt: now, TTL: ttl}
 	}
 	return nil
 }
 
-func (h *Http) PrefetchUserGroups() {
+// PrefetchUserGroups fetches all users and groups, and the lists of prefetch_paths,
+// and swaps them into the cache at once.
+// The previous generation is kept when users or groups fail, or too many of them are deleted.
+// A path of prefetch_paths which fails keeps its previous entries, and the others are applied.
+// It returns an error when upstream fails.
+func (h *Http) PrefetchUserGroups() error {
+	return h.prefetch(false)
+}
+
+// prefetch is PrefetchUserGroups, which doesn't check the deletions when force is true.
+func (h *Http) prefetch(force bool) error {
 	logrus.Info("start prefetch")
-	users := []*model.User{}
-	groups := []*model.Group{}
+	gen := newGeneration()
+	if err := h.prefetchUserOrGroup("users", gen); err != nil {
+		logrus.Errorf("prefetch: keep the previous generation: %s", err)
+		return err
+	}
+	if err := h.prefetchUserOrGroup("groups", gen); err != nil {
+		logrus.Errorf("prefetch: keep the previous generation: %s", err)
+		return err
+	}
 
-	if err := h.prefetchUserOrGroup("users", users); err != nil {
-		logrus.Error(err)
+	var pathErr error
+	for _, p := range h.Config().Cached.PrefetchPaths {
+		if err := h.prefetchPath(p, gen); err != nil {
+			n := gen.keep(h.currentGeneration(), p.Resource(), time.Now())
+			logrus.Errorf("prefetch: keep the previous %d entries of %s: %s", n, p.Resource(), err)
+			pathErr = err
+		}
 	}
-	if err := h.prefetchUserOrGroup("groups", groups); err != nil {
-		logrus.Error(err)
+	if !force && h.guardPrefetch(gen) {
+		return pathErr
 	}
+	h.swapGeneration(gen)
 	logrus.Info("finish prefetch")
-
+	return pathErr
 }
 
 func (h *Http) cacheKey(requestPath, query string) (string, error) {
-	u, err := url.Parse(h.config.ApiEndpoint)
+	u, err := url.Parse(h.Config().ApiEndpoint)
 	if err != nil {
 		return "", err
 	}
 
 	u.Path = path.Join(u.Path, requestPath)
-	u.RawQuery = query
+	u.RawQuery = canonicalQuery(query)
 	return u.String(), nil
 
 }
+
+// canonicalQuery returns the query escaped and sorted by url.Values, so lookups escaped differently
+// by clients share the cache key. An invalid query is returned as it is.
+func canonicalQuery(query string) string {
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return query
+	}
+	return q.Encode()
+}
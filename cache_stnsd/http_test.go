@@ -0,0 +1,83 @@
+package cache_stnsd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ReneKroon/ttlcache/v2"
+)
+
+func TestHttp_Reload(t *testing.T) {
+	tokens := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens = append(tokens, r.Header.Get("Authorization"))
+		w.Write([]byte(`[]`))
+	}))
+	defer ts.Close()
+
+	c := ttlcache.NewCache()
+	defer c.Close()
+
+	h, err := NewHttp(&Config{
+		ApiEndpoint: ts.URL,
+		AuthToken:   "old",
+		Cache:       true,
+		CacheTTL:    600,
+	}, c, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := h.Request("users", "name=old"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Reload(&Config{
+		ApiEndpoint: ts.URL,
+		AuthToken:   "new",
+		Cache:       true,
+		CacheTTL:    600,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if h.Config().AuthToken != "new" {
+		t.Errorf("config was not reloaded: %s", h.Config().AuthToken)
+	}
+
+	isCache, _, err := h.Request("users", "name=old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isCache {
+		t.Error("cache should be kept after reload")
+	}
+
+	if _, _, err := h.Request("users", "name=new"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tokens) != 2 || tokens[0] != "token old" || tokens[1] != "token new" {
+		t.Errorf("unexpected tokens: %v", tokens)
+	}
+}
+
+func Test_canonicalQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", ""},
+		{"name=example", "name=example"},
+		{"name=web%201", "name=web+1"},
+		{"name=a%26b", "name=a%26b"},
+		{"name=a&id=1", "id=1&name=a"},
+		{"name=%zz", "name=%zz"},
+	}
+	for _, tt := range tests {
+		if got := canonicalQuery(tt.query); got != tt.want {
+			t.Errorf("canonicalQuery(%s) = %s, want %s", tt.query, got, tt.want)
+		}
+	}
+}
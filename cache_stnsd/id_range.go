@@ -0,0 +1,52 @@
+package cache_stnsd
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// idRange is the highest and the lowest id of users or groups,
+// returned as headers such as User-Highest-Id like STNS.
+type idRange struct {
+	highest int
+	lowest  int
+}
+
+func newIDRange(entries []principalEntry) idRange {
+	r := idRange{}
+	for _, e := range entries {
+		r.add(e.id)
+	}
+	return r
+}
+
+// add extends the range by the id. 0 is not an id of STNS.
+func (r *idRange) add(id int) {
+	if id <= 0 {
+		return
+	}
+	if r.highest == 0 || id > r.highest {
+		r.highest = id
+	}
+	if r.lowest == 0 || id < r.lowest {
+		r.lowest = id
+	}
+}
+
+func idRangeHeaders(resource string) (string, string) {
+	if resource == "groups" {
+		return "Group-Highest-Id", "Group-Lowest-Id"
+	}
+	return "User-Highest-Id", "User-Lowest-Id"
+}
+
+// setHeader replaces the headers of upstream. They are removed when there is no id, as STNS does.
+func (r idRange) setHeader(header http.Header, resource string) {
+	highest, lowest := idRangeHeaders(resource)
+	header.Del(highest)
+	header.Del(lowest)
+	if r.highest != 0 && r.lowest != 0 {
+		header.Set(highest, strconv.Itoa(r.highest))
+		header.Set(lowest, strconv.Itoa(r.lowest))
+	}
+}
@@ -0,0 +1,88 @@
+package cache_stnsd
+
+import (
+	"net/http"
+	"testing"
+)
+
+func Test_idRange(t *testing.T) {
+	tests := []struct {
+		name        string
+		ids         []int
+		wantHighest string
+		wantLowest  string
+	}{
+		{name: "ids", ids: []int{1001, 1000, 1002}, wantHighest: "1002", wantLowest: "1000"},
+		{name: "one", ids: []int{1000}, wantHighest: "1000", wantLowest: "1000"},
+		{name: "zero is ignored", ids: []int{0, 1001, 1000}, wantHighest: "1001", wantLowest: "1000"},
+		{name: "empty", ids: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries := []principalEntry{}
+			for _, id := range tt.ids {
+				entries = append(entries, principalEntry{id: id})
+			}
+			header := http.Header{}
+			header.Set("User-Highest-Id", "9999")
+			header.Set("User-Lowest-Id", "1")
+			newIDRange(entries).setHeader(header, "users")
+			if got := header.Get("User-Highest-Id"); got != tt.wantHighest {
+				t.Errorf("User-Highest-Id = %q, want %q", got, tt.wantHighest)
+			}
+			if got := header.Get("User-Lowest-Id"); got != tt.wantLowest {
+				t.Errorf("User-Lowest-Id = %q, want %q", got, tt.wantLowest)
+			}
+		})
+	}
+}
+
+func TestHttp_PrefetchIDRange(t *testing.T) {
+	f := newFakeSTNS(t, map[string]string{
+		"/users":  `[{"id":1000,"name":"alice"},{"id":1001,"name":"bob"},{"id":1002,"name":"carol"}]`,
+		"/groups": `[{"id":2000,"name":"dev","users":["alice"]},{"id":2001,"name":"ops","users":["bob"]}]`,
+	})
+	// the headers of upstream are wrong, such as another backend of a proxy
+	for _, k := range []string{"User-Highest-Id", "Group-Highest-Id"} {
+		f.setHeader(k, "9999")
+	}
+	for _, k := range []string{"User-Lowest-Id", "Group-Lowest-Id"} {
+		f.setHeader(k, "1")
+	}
+	h := newTestHttp(t, f, Config{NegativeCacheTTL: 600, Cached: Cached{Prefetch: true, Authoritative: true}})
+
+	check := func(path, query, highest, lowest string) {
+		t.Helper()
+		prefix := "User"
+		if path == "groups" {
+			prefix = "Group"
+		}
+		_, res, err := h.Request(path, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := res.Header.Get(prefix + "-Highest-Id"); got != highest {
+			t.Errorf("%s?%s %s-Highest-Id = %q, want %q", path, query, prefix, got, highest)
+		}
+		if got := res.Header.Get(prefix + "-Lowest-Id"); got != lowest {
+			t.Errorf("%s?%s %s-Lowest-Id = %q, want %q", path, query, prefix, got, lowest)
+		}
+	}
+
+	h.PrefetchUserGroups()
+	check("users", "", "1002", "1000")
+	check("users", "name=alice", "1002", "1000")
+	check("users", "id=1002", "1002", "1000")
+	check("users", "name=nobody", "1002", "1000")
+	check("groups", "", "2001", "2000")
+	check("groups", "name=dev", "2001", "2000")
+	check("groups", "member=bob", "2001", "2000")
+
+	// carol is deleted
+	f.setList("/users", `[{"id":1000,"name":"alice"},{"id":1001,"name":"bob"}]`)
+
+	h.PrefetchUserGroups()
+	check("users", "", "1001", "1000")
+	check("users", "name=alice", "1001", "1000")
+	check("users", "id=1002", "1001", "1000")
+}
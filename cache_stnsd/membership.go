@@ -0,0 +1,104 @@
+package cache_stnsd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/STNS/STNS/v2/model"
+)
+
+// membershipQuery is the query to find the supplementary groups of a user
+// such as "/groups?member=example", used by initgroups.
+const membershipQuery = "member"
+
+// membershipUser returns the user name of a membership query.
+func membershipUser(requestPath, query string) (string, bool) {
+	if strings.Trim(path.Clean("/"+requestPath), "/") != "groups" {
+		return "", false
+	}
+
+	q, err := url.ParseQuery(query)
+	if err != nil || len(q) != 1 {
+		return "", false
+	}
+	v, ok := q[membershipQuery]
+	if !ok || len(v) != 1 || v[0] == "" {
+		return "", false
+	}
+	return v[0], true
+}
+
+// buildMemberships returns the reverse index from a user name to the groups it belongs to.
+func buildMemberships(groups []*model.Group) map[string][]*model.Group {
+	m := map[string][]*model.Group{}
+	for _, g := range groups {
+		seen := map[string]bool{}
+		for _, u := range g.Users {
+			if seen[u] {
+				continue
+			}
+			seen[u] = true
+			m[u] = append(m[u], g)
+		}
+	}
+	return m
+}
+
+// membershipResponse returns the groups of the user as a list of STNS.
+func membershipResponse(groups []*model.Group, header http.Header) (*Response, error) {
+	if groups == nil {
+		groups = []*model.Group{}
+	}
+	body, err := json.Marshal(groups)
+	if err != nil {
+		return nil, err
+	}
+	res := jsonResponse(http.StatusOK, body)
+	for _, k := range []string{"Group-Highest-Id", "Group-Lowest-Id"} {
+		if v := header.Get(k); v != "" {
+			res.Header.Set(k, v)
+		}
+	}
+	return res, nil
+}
+
+// membershipRequest answers a membership query from the prefetched groups, or from the list of groups.
+// It is never forwarded to upstream, because STNS doesn't know the query.
+func (h *Http) membershipRequest(name, cacheKey string, cc RequestCacheControl) (CacheStatus, *Response, error) {
+	if h.Config().Cache && !cc.NoCache {
+		gen := h.currentGeneration()
+		if d, ok := gen.fresh("groups", time.Now()); ok {
+			age := time.Since(d.StoredAt)
+			if cc.MaxAge == 0 || age <= cc.MaxAge {
+				header := http.Header{}
+				gen.idRanges["groups"].setHeader(header, "groups")
+				res, err := membershipResponse(gen.memberships[name], header)
+				if err != nil {
+					return CacheStatus{Key: cacheKey}, nil, err
+				}
+				return CacheStatus{Hit: true, TTL: d.TTL - age, Age: age, Key: cacheKey, Detail: "membership"}, res, nil
+			}
+		}
+	}
+
+	status, list, err := h.RequestWithCacheControl("groups", "", cc)
+	status.Key = cacheKey
+	if err != nil || list.StatusCode != http.StatusOK {
+		return status, list, err
+	}
+	if status.Detail == "" {
+		status.Detail = "membership"
+	}
+
+	groups := []*model.Group{}
+	if err := json.Unmarshal(list.Body, &groups); err != nil {
+		return status, nil, NewError(http.StatusBadGateway, ErrorCodeUpstreamError, fmt.Sprintf("invalid groups: %s", err))
+	}
+	res, err := membershipResponse(buildMemberships(groups)[name], list.Header)
+	return status, res, err
+}
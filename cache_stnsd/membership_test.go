@@ -0,0 +1,88 @@
+package cache_stnsd
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/STNS/STNS/v2/model"
+)
+
+func Test_buildMemberships(t *testing.T) {
+	groups := []*model.Group{
+		{Base: model.Base{ID: 1000, Name: "dev"}, Users: []string{"alice", "bob"}},
+		{Base: model.Base{ID: 1001, Name: "ops"}, Users: []string{"bob", "carol", "bob"}},
+		{Base: model.Base{ID: 1002, Name: "all"}, Users: []string{"alice", "bob", "carol"}},
+		{Base: model.Base{ID: 1003, Name: "empty"}},
+	}
+
+	got := map[string][]string{}
+	for u, gs := range buildMemberships(groups) {
+		for _, g := range gs {
+			got[u] = append(got[u], g.Name)
+		}
+	}
+
+	want := map[string][]string{
+		"alice": {"dev", "all"},
+		"bob":   {"dev", "ops", "all"},
+		"carol": {"ops", "all"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("buildMemberships() = %v, want %v", got, want)
+	}
+}
+
+func TestHttp_Membership(t *testing.T) {
+	f := newFakeSTNS(t, map[string]string{
+		"/groups": `[{"id":1000,"name":"dev","users":["alice","bob"]},{"id":1001,"name":"ops","users":["bob","carol"]},{"id":1002,"name":"all","users":["alice","bob","carol"]}]`,
+	})
+	h := newTestHttp(t, f, Config{Cached: Cached{Prefetch: true}})
+
+	// not prefetched yet, answered from the list of groups
+	status, res, err := h.RequestWithCacheControl("groups", "member=bob", RequestCacheControl{})
+	if err != nil || res.StatusCode != http.StatusOK || status.Hit || status.Detail != "membership" {
+		t.Errorf("membership query before prefetch = %+v, %v", status, err)
+	}
+	if string(res.Body) != `[{"id":1000,"name":"dev","users":["alice","bob"]},{"id":1001,"name":"ops","users":["bob","carol"]},{"id":1002,"name":"all","users":["alice","bob","carol"]}]` {
+		t.Errorf("membership body = %s", res.Body)
+	}
+
+	h.PrefetchUserGroups()
+
+	tests := []struct {
+		name string
+		want []int
+	}{
+		{"alice", []int{1000, 1002}},
+		{"bob", []int{1000, 1001, 1002}},
+		{"carol", []int{1001, 1002}},
+		{"dave", []int{}},
+	}
+	for _, tt := range tests {
+		isCache, res, err := h.Request("/groups", "member="+tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isCache || res.StatusCode != http.StatusOK {
+			t.Errorf("%s: isCache = %v, status code = %d", tt.name, isCache, res.StatusCode)
+		}
+
+		groups := []*model.Group{}
+		if err := json.Unmarshal(res.Body, &groups); err != nil {
+			t.Fatal(err)
+		}
+		got := []int{}
+		for _, g := range groups {
+			got = append(got, g.ID)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: groups = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if lookups := f.lookupCount(); lookups != 0 {
+		t.Errorf("membership query should not be forwarded to upstream: %d", lookups)
+	}
+}
@@ -0,0 +1,81 @@
+package cache_stnsd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/STNS/libstns-go/libstns"
+)
+
+// QueryWrapper executes an external command in place of the STNS HTTP API,
+// the same way libnss-stns does with query_wrapper.
+// The command receives the request path and query as its only argument
+// (e.g. "/users?name=foo") and must print JSON on stdout.
+//
+//	exit code 0: 200 OK
+//	exit code 1: 404 Not Found
+//	other:       500 Internal Server Error
+type QueryWrapper struct {
+	command string
+	timeout time.Duration
+}
+
+func NewQueryWrapper(command string, timeout int) *QueryWrapper {
+	if timeout <= 0 {
+		timeout = libstns.DefaultTimeout
+	}
+	return &QueryWrapper{
+		command: command,
+		timeout: time.Duration(timeout) * time.Second,
+	}
+}
+
+func (q *QueryWrapper) Request(path, query string) (*Response, error) {
+	arg := "/" + strings.TrimLeft(path, "/")
+	if query != "" {
+		arg = fmt.Sprintf("%s?%s", arg, query)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), q.timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, q.command, arg)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// don't wait for grandchildren that still hold stdout after a timeout
+	cmd.WaitDelay = 100 * time.Millisecond
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("query wrapper timeout: %s %s: %w", q.command, arg, ctx.Err())
+	}
+
+	res := &Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       stdout.Bytes(),
+	}
+
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return nil, err
+		}
+
+		switch exitErr.ExitCode() {
+		case 1:
+			res.StatusCode = http.StatusNotFound
+		default:
+			res.StatusCode = http.StatusInternalServerError
+		}
+		return res, fmt.Errorf("query wrapper %s %s: status code=%d, stderr=%s", q.command, arg, res.StatusCode, stderr.String())
+	}
+	return res, nil
+}
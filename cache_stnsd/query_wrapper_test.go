@@ -0,0 +1,95 @@
+package cache_stnsd
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/ReneKroon/ttlcache/v2"
+)
+
+func TestQueryWrapper_Request(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		query      string
+		wantStatus int
+		wantBody   string
+		wantErr    bool
+	}{
+		{
+			name:       "ok",
+			path:       "users",
+			query:      "name=test",
+			wantStatus: http.StatusOK,
+			wantBody:   "[{\"id\":1,\"name\":\"test\"}]\n",
+		},
+		{
+			name:       "notfound",
+			path:       "users",
+			query:      "name=notfound",
+			wantStatus: http.StatusNotFound,
+			wantErr:    true,
+		},
+		{
+			name:       "error",
+			path:       "error",
+			wantStatus: http.StatusInternalServerError,
+			wantErr:    true,
+		},
+		{
+			name:    "timeout",
+			path:    "sleep",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := NewQueryWrapper("./testdata/query_wrapper.sh", 1)
+			got, err := q.Request(tt.path, tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("QueryWrapper.Request() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantStatus == 0 {
+				if got != nil {
+					t.Errorf("QueryWrapper.Request() = %v, want nil", got)
+				}
+				return
+			}
+			if got.StatusCode != tt.wantStatus {
+				t.Errorf("QueryWrapper.Request() status = %d, want %d", got.StatusCode, tt.wantStatus)
+			}
+			if tt.wantBody != "" && string(got.Body) != tt.wantBody {
+				t.Errorf("QueryWrapper.Request() body = %s, want %s", got.Body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestHttp_RequestWithQueryWrapper(t *testing.T) {
+	c := ttlcache.NewCache()
+	defer c.Close()
+
+	h, err := NewHttp(&Config{
+		ApiEndpoint:  "http://localhost:1104/v1",
+		QueryWrapper: "./testdata/query_wrapper.sh",
+		Cache:        true,
+		CacheTTL:     600,
+	}, c, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []bool{false, true} {
+		isCache, res, err := h.Request("users", "name=test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isCache != want {
+			t.Errorf("request %d: isCache = %v, want %v", i, isCache, want)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("request %d: status = %d, want %d", i, res.StatusCode, http.StatusOK)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package cache_stnsd
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/STNS/STNS/v2/model"
+)
+
+// staleSnapshotTTL is the ttl of an expired entry restored from the snapshot.
+// The entry is kept by the expiration callback while upstream is down, as in the old process.
+const staleSnapshotTTL = time.Minute
+
+type snapshotItem struct {
+	Key      string        `json:"key"`
+	Response Response      `json:"response"`
+	StoredAt time.Time     `json:"stored_at"`
+	TTL      time.Duration `json:"ttl"`
+}
+
+// snapshot is the cache and the prefetch state passed to the new process.
+// The old format is the list of items.
+type snapshot struct {
+	Items      []snapshotItem      `json:"items"`
+	Generation *generationSnapshot `json:"generation,omitempty"`
+	Guard      *PrefetchGuard      `json:"guard,omitempty"`
+}
+
+// generationSnapshot is the prefetched generation. Its entries are in the items of the snapshot,
+// and the memberships are built again from the list of groups, so the snapshot grows linearly.
+type generationSnapshot struct {
+	Keys        []string                  `json:"keys"`
+	Directories map[string]directory      `json:"directories"`
+	Principals  map[string]map[string]int `json:"principals"`
+}
+
+func newGenerationSnapshot(g *generation) *generationSnapshot {
+	if g == nil {
+		return nil
+	}
+	s := &generationSnapshot{
+		Keys:        make([]string, 0, len(g.entries)),
+		Directories: g.directories,
+		Principals:  g.principals,
+	}
+	for k := range g.entries {
+		s.Keys = append(s.Keys, k)
+	}
+	return s
+}
+
+// generation restores the generation with the entries of the items.
+// Keys missing in the items are not restored.
+func (s *generationSnapshot) generation(items map[string]snapshotItem) *generation {
+	if s == nil {
+		return nil
+	}
+	g := newGeneration()
+	for _, k := range s.Keys {
+		if i, ok := items[k]; ok {
+			g.set(i.Key, i.Response, i.StoredAt, i.TTL)
+		}
+	}
+	if s.Directories != nil {
+		g.directories = s.Directories
+	}
+	for resource, names := range s.Principals {
+		for name, id := range names {
+			g.addPrincipal(resource, name, id)
+			if resource == "users" || resource == "groups" {
+				r := g.idRanges[resource]
+				r.add(id)
+				g.idRanges[resource] = r
+			}
+		}
+	}
+
+	if d, ok := g.directories["groups"]; ok {
+		groups := []*model.Group{}
+		if e, ok := g.entries[d.Key]; ok && json.Unmarshal(e.Response.Body, &groups) == nil {
+			g.memberships = buildMemberships(groups)
+		} else {
+			// membership queries are answered from the list of groups again
+			delete(g.directories, "groups")
+		}
+	}
+	return g
+}
+
+// WriteSnapshot writes the cached responses, including the expired ones kept while upstream is down,
+// and the prefetched users and groups.
+func (h *Http) WriteSnapshot(w io.Writer) error {
+	s := snapshot{Items: []snapshotItem{}}
+	for k, v := range h.cache.GetItems() {
+		e, ok := v.(cacheEntry)
+		if !ok {
+			continue
+		}
+		s.Items = append(s.Items, snapshotItem{
+			Key:      k,
+			Response: e.Response,
+			StoredAt: e.StoredAt,
+			TTL:      e.TTL,
+		})
+	}
+
+	h.mu.RLock()
+	s.Generation = newGenerationSnapshot(h.generation)
+	if h.guard != nil {
+		guard := *h.guard
+		s.Guard = &guard
+	}
+	h.mu.RUnlock()
+	return json.NewEncoder(w).Encode(s)
+}
+
+// LoadSnapshot restores the responses written by WriteSnapshot with the remaining TTL,
+// and the prefetched users and groups. Expired responses are restored with staleSnapshotTTL,
+// and checked by the expiration callback.
+// It returns the number of restored entries.
+func (h *Http) LoadSnapshot(r io.Reader) (int, error) {
+	raw := json.RawMessage{}
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return 0, err
+	}
+
+	s := snapshot{}
+	if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("[")) {
+		if err := json.Unmarshal(raw, &s.Items); err != nil {
+			return 0, err
+		}
+	} else if err := json.Unmarshal(raw, &s); err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	n := 0
+	items := make(map[string]snapshotItem, len(s.Items))
+	for _, i := range s.Items {
+		remaining := i.StoredAt.Add(i.TTL).Sub(now)
+		if remaining <= 0 {
+			remaining = staleSnapshotTTL
+		}
+		items[i.Key] = i
+
+		h.cache.SetWithTTL(i.Key, cacheEntry{
+			Response: i.Response,
+			StoredAt: i.StoredAt,
+			TTL:      i.TTL,
+		}, remaining)
+		n++
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.generation = s.Generation.generation(items)
+	h.guard = s.Guard
+	return n, nil
+}
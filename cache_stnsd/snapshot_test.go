@@ -0,0 +1,166 @@
+package cache_stnsd
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ReneKroon/ttlcache/v2"
+)
+
+func TestHttp_Snapshot(t *testing.T) {
+	config := &Config{
+		ApiEndpoint: "http://localhost:1104/v1",
+		Cache:       true,
+		CacheTTL:    600,
+	}
+
+	src := ttlcache.NewCache()
+	defer src.Close()
+	h, err := NewHttp(config, src, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := Response{
+		StatusCode: http.StatusOK,
+		Body:       []byte(`[{"id":1,"name":"test"}]`),
+		Header:     http.Header{"User-Highest-Id": {"1"}},
+	}
+	key, _ := h.cacheKey("users", "name=test")
+	h.setCache(key, res, 10*time.Second)
+	expired, _ := h.cacheKey("users", "name=expired")
+	src.SetWithTTL(expired, cacheEntry{Response: res, StoredAt: time.Now().Add(-time.Hour), TTL: time.Minute}, time.Minute)
+
+	var b bytes.Buffer
+	if err := h.WriteSnapshot(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := ttlcache.NewCache()
+	defer dst.Close()
+	restored, err := NewHttp(config, dst, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := restored.LoadSnapshot(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("LoadSnapshot() = %d, want 2", n)
+	}
+
+	isCache, got, err := restored.Request("users", "name=test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isCache || string(got.Body) != string(res.Body) || got.Header.Get("User-Highest-Id") != "1" {
+		t.Errorf("restored response = %v, %v", isCache, got)
+	}
+
+	_, ttl, err := dst.GetWithTTL(key)
+	if err != nil || ttl > 10*time.Second {
+		t.Errorf("restored ttl = %s, %v, want remaining ttl", ttl, err)
+	}
+
+	// kept by the expiration callback while upstream is down
+	_, ttl, err = dst.GetWithTTL(expired)
+	if err != nil || ttl <= 0 || ttl > staleSnapshotTTL {
+		t.Errorf("restored ttl of the expired entry = %s, %v, want %s", ttl, err, staleSnapshotTTL)
+	}
+	status, _, err := restored.RequestWithCacheControl("users", "name=expired", RequestCacheControl{})
+	if err != nil || !status.Hit || status.Detail != "fallback" {
+		t.Errorf("expired entry should be answered as fallback: %v %v", status, err)
+	}
+}
+
+func TestHttp_SnapshotGeneration(t *testing.T) {
+	f := newFakeSTNS(t, map[string]string{
+		"/users":  `[{"id":1000,"name":"alice"},{"id":1001,"name":"bob"}]`,
+		"/groups": `[{"id":2000,"name":"dev","users":["alice"]}]`,
+	})
+	config := Config{Cached: Cached{Prefetch: true, Authoritative: true, MaxDeletionPercent: 50}}
+	h := newTestHttp(t, f, config)
+	h.PrefetchUserGroups()
+	f.setList("/users", `[]`)
+	h.PrefetchUserGroups()
+	if h.PrefetchGuard() == nil {
+		t.Fatal("prefetch should be refused")
+	}
+
+	var b bytes.Buffer
+	if err := h.WriteSnapshot(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newTestHttp(t, f, config)
+	if _, err := restored.LoadSnapshot(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	if restored.PrefetchGuard() == nil {
+		t.Error("guard should be restored")
+	}
+	status, res, err := restored.RequestWithCacheControl("users", "name=nobody", RequestCacheControl{})
+	if err != nil || status.Detail != "authoritative" || res.Header.Get("User-Highest-Id") != "1001" {
+		t.Errorf("authoritative answer should be restored: %v %v", status, err)
+	}
+	if status, _, err := restored.RequestWithCacheControl("groups", "member=alice", RequestCacheControl{}); err != nil || status.Detail != "membership" {
+		t.Errorf("membership should be restored: %v %v", status, err)
+	}
+
+	// the next prefetch is still compared with the restored users
+	restored.PrefetchUserGroups()
+	if isCache, _, _ := restored.Request("users", "name=alice"); !isCache {
+		t.Error("users?name=alice should be kept by the guard")
+	}
+
+	if err := restored.ApplyPendingPrefetch(); err != nil {
+		t.Errorf("restored refusal should be applied: %s", err)
+	}
+}
+
+func TestHttp_SnapshotSize(t *testing.T) {
+	size := func(members int) int {
+		f := newFakeSTNS(t, map[string]string{
+			"/users":  string(syntheticUsers(members)),
+			"/groups": string(syntheticGroups(1, members)),
+		})
+		h := newTestHttp(t, f, Config{Cached: Cached{Prefetch: true}})
+		if err := h.PrefetchUserGroups(); err != nil {
+			t.Fatal(err)
+		}
+
+		var b bytes.Buffer
+		if err := h.WriteSnapshot(&b); err != nil {
+			t.Fatal(err)
+		}
+		return b.Len()
+	}
+
+	// the groups are not written for each member
+	small, large := size(1000), size(4000)
+	if large > small*5 {
+		t.Errorf("snapshot of 4000 members = %d bytes, 1000 members = %d bytes, want linear", large, small)
+	}
+}
+
+func TestHttp_LoadSnapshotList(t *testing.T) {
+	c := ttlcache.NewCache()
+	defer c.Close()
+	h, err := NewHttp(&Config{ApiEndpoint: "http://localhost:1104/v1", Cache: true, CacheTTL: 600}, c, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// written by the previous version
+	old := `[{"key":"http://localhost:1104/v1/users?name=test","response":{"StatusCode":200},"stored_at":"` +
+		time.Now().Format(time.RFC3339Nano) + `","ttl":600000000000}]`
+	if n, err := h.LoadSnapshot(strings.NewReader(old)); err != nil || n != 1 {
+		t.Errorf("LoadSnapshot() = %d, %v, want 1", n, err)
+	}
+}
@@ -0,0 +1,20 @@
+#!/bin/sh
+case "$1" in
+  "/users?name=test")
+    echo '[{"id":1,"name":"test"}]'
+    ;;
+  "/status")
+    echo '{}'
+    ;;
+  "/sleep")
+    sleep 5
+    ;;
+  "/error")
+    echo '{"error":"wrapper"}'
+    echo "error" >&2
+    exit 2
+    ;;
+  *)
+    exit 1
+    ;;
+esac
@@ -0,0 +1,278 @@
+package cache_stnsd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/STNS/libstns-go/libstns"
+	"github.com/caarlos0/env"
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+const (
+	CacheHeader         = "STNSD-CACHE"
+	UpstreamCacheHeader = "STNSD-UPSTREAM-CACHE"
+	VersionHeader       = "X-Cache-STNSD-Version"
+)
+
+// headers not stored in the cache nor forwarded to clients
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Transfer-Encoding",
+	"Upgrade",
+	"Trailer",
+	"Content-Length",
+}
+
+// Response is a response from upstream.
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// upstream is the backend that answers requests which are not in the cache.
+type upstream interface {
+	Request(path, query string) (*Response, error)
+}
+
+// streamer is an upstream which returns the body while it is read, to decode a large list without holding it twice.
+// The body is only returned for 200, and must be closed.
+type streamer interface {
+	Stream(path, query string) (*Response, io.ReadCloser, error)
+}
+
+// requestStream requests the path with Stream of the upstream if it is supported.
+func requestStream(client upstream, path, query string) (*Response, io.ReadCloser, error) {
+	if s, ok := client.(streamer); ok {
+		return s.Stream(path, query)
+	}
+
+	res, err := client.Request(path, query)
+	if err != nil || res.StatusCode != http.StatusOK {
+		return res, nil, err
+	}
+	return res, io.NopCloser(bytes.NewReader(res.Body)), nil
+}
+
+// HTTPUpstream requests the STNS API over http(s) with the same options as libstns.
+// libstns.Response keeps only the id range headers with their first value,
+// so the request is sent here to keep every header such as Cache-Control and Expires.
+type HTTPUpstream struct {
+	endpoint   string
+	opt        *libstns.Options
+	httpClient *http.Client
+}
+
+// upstreamOptions returns the options of libstns for the config.
+// The environment variables of libstns such as STNS_AUTH_TOKEN and STNS_REQUEST_TIMEOUT override them.
+func upstreamOptions(config *Config, version string) (*libstns.Options, error) {
+	opt := &libstns.Options{
+		AuthToken:      config.AuthToken,
+		User:           config.User,
+		Password:       config.Password,
+		UserAgent:      ProductName(version),
+		SkipSSLVerify:  !config.SSLVerify,
+		HttpProxy:      config.HttpProxy,
+		HttpKeepalive:  config.HttpKeepalive,
+		RequestTimeout: config.RequestTimeout,
+		RequestRetry:   config.RequestRetry,
+		HttpHeaders:    config.HttpHeaders,
+		TLS:            config.TLS,
+	}
+	if err := env.Parse(opt); err != nil {
+		return nil, err
+	}
+
+	if opt.RequestTimeout <= 0 {
+		opt.RequestTimeout = libstns.DefaultTimeout
+	}
+	if opt.RequestRetry <= 0 {
+		opt.RequestRetry = libstns.DefaultRetry
+	}
+	return opt, nil
+}
+
+func NewHTTPUpstream(endpoint string, opt *libstns.Options) (*HTTPUpstream, error) {
+	tr := &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: time.Duration(opt.RequestTimeout) * time.Second,
+		}).DialContext,
+		DisableKeepAlives: !opt.HttpKeepalive,
+		Proxy:             http.ProxyFromEnvironment,
+	}
+
+	if opt.HttpProxy != "" {
+		if u, err := url.Parse(opt.HttpProxy); err == nil {
+			tr.Proxy = http.ProxyURL(u)
+		}
+	}
+
+	if strings.HasPrefix(endpoint, "https") {
+		tc, err := clientTLSConfig(opt)
+		if err != nil {
+			return nil, err
+		}
+		tr.TLSClientConfig = tc
+	}
+
+	rc := retryablehttp.NewClient()
+	rc.HTTPClient.Transport = tr
+	rc.RetryMax = opt.RequestRetry
+	rc.RetryWaitMin = 100 * time.Millisecond
+	rc.RetryWaitMax = time.Second
+	rc.Logger = nil
+	// return the last response to forward the error body of upstream
+	rc.ErrorHandler = retryablehttp.PassthroughErrorHandler
+
+	return &HTTPUpstream{
+		endpoint:   endpoint,
+		opt:        opt,
+		httpClient: rc.StandardClient(),
+	}, nil
+}
+
+// ProductName returns "cache-stnsd/<version>" used as User-Agent and Server.
+func ProductName(version string) string {
+	if version == "" {
+		return "cache-stnsd"
+	}
+	return fmt.Sprintf("cache-stnsd/%s", version)
+}
+
+// clientTLSConfig returns the tls config in the same way as libstns.
+// It is nil when the default config of Go is enough.
+func clientTLSConfig(opt *libstns.Options) (*tls.Config, error) {
+	tc := &tls.Config{InsecureSkipVerify: opt.SkipSSLVerify}
+	if opt.TLS.CA != "" {
+		ca, err := os.ReadFile(opt.TLS.CA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(ca)
+		tc.RootCAs = pool
+	}
+
+	if opt.TLS.Cert != "" && opt.TLS.Key != "" {
+		cert, err := tls.LoadX509KeyPair(opt.TLS.Cert, opt.TLS.Key)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(tc.Certificates) == 0 && tc.RootCAs == nil && !tc.InsecureSkipVerify {
+		return nil, nil
+	}
+	return tc, nil
+}
+
+func (c *HTTPUpstream) Request(requestPath, query string) (*Response, error) {
+	resp, err := c.do(requestPath, query)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return newResponse(resp)
+}
+
+// Stream is Request which returns the body of 200 as it is read from upstream.
+func (c *HTTPUpstream) Stream(requestPath, query string) (*Response, io.ReadCloser, error) {
+	resp, err := c.do(requestPath, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	return streamResponse(resp)
+}
+
+func (c *HTTPUpstream) do(requestPath, query string) (*http.Response, error) {
+	u, err := url.Parse(c.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path.Join(u.Path, requestPath)
+	u.RawQuery = query
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range c.opt.HttpHeaders {
+		req.Header.Add(k, v)
+	}
+	req.Header.Set("User-Agent", c.opt.UserAgent)
+
+	if c.opt.AuthToken != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("token %s", c.opt.AuthToken))
+	}
+
+	if c.opt.User != "" && c.opt.Password != "" {
+		req.SetBasicAuth(c.opt.User, c.opt.Password)
+	}
+
+	return c.httpClient.Do(req)
+}
+
+// newResponse reads the response of upstream.
+// It returns an error with the response when the status is not 200.
+func newResponse(resp *http.Response) (*Response, error) {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Response{
+		StatusCode: resp.StatusCode,
+		Header:     responseHeader(resp),
+		Body:       body,
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return r, fmt.Errorf("status code=%d, body=%s", resp.StatusCode, string(body))
+	}
+	return r, nil
+}
+
+// streamResponse returns the response of 200 without the body and the body to be read.
+// Other responses are read by newResponse.
+func streamResponse(resp *http.Response) (*Response, io.ReadCloser, error) {
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		r, err := newResponse(resp)
+		return r, nil, err
+	}
+
+	return &Response{
+		StatusCode: resp.StatusCode,
+		Header:     responseHeader(resp),
+	}, resp.Body, nil
+}
+
+// responseHeader returns the headers of upstream without the hop-by-hop headers,
+// and with STNSD-CACHE of a parent cache-stnsd renamed.
+func responseHeader(resp *http.Response) http.Header {
+	header := resp.Header.Clone()
+	for _, h := range hopHeaders {
+		header.Del(h)
+	}
+
+	if v := header.Get(CacheHeader); v != "" {
+		header.Del(CacheHeader)
+		header.Set(UpstreamCacheHeader, v)
+	}
+	return header
+}
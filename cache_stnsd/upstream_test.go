@@ -0,0 +1,221 @@
+package cache_stnsd
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ReneKroon/ttlcache/v2"
+	"github.com/STNS/libstns-go/libstns"
+)
+
+func TestHttp_RequestHeaders(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("Authorization") != "token secret" {
+			t.Errorf("unexpected authorization: %s", r.Header.Get("Authorization"))
+		}
+		if r.URL.Query().Get("name") == "nostore" {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		w.Header().Add("X-Multi", "a")
+		w.Header().Add("X-Multi", "b")
+		w.Header().Set("Connection", "close")
+		w.Write([]byte(`[]`))
+	}))
+	defer ts.Close()
+
+	c := ttlcache.NewCache()
+	defer c.Close()
+	h, err := NewHttp(&Config{
+		ApiEndpoint: ts.URL,
+		AuthToken:   "secret",
+		Cache:       true,
+		CacheTTL:    600,
+	}, c, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, res, err := h.Request("users", "name=test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(res.Header.Values("X-Multi"), []string{"a", "b"}) {
+			t.Errorf("multi-valued header = %v", res.Header.Values("X-Multi"))
+		}
+		if res.Header.Get("Connection") != "" {
+			t.Error("hop-by-hop header should not be stored")
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		isCache, _, err := h.Request("users", "name=nostore")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isCache {
+			t.Error("no-store response should not be cached")
+		}
+	}
+
+	if requests != 3 {
+		t.Errorf("upstream requests = %d, want 3", requests)
+	}
+}
+
+func TestHttp_RequestWithCacheControl(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`[]`))
+	}))
+	defer ts.Close()
+
+	c := ttlcache.NewCache()
+	defer c.Close()
+	h, err := NewHttp(&Config{
+		ApiEndpoint: ts.URL,
+		Cache:       true,
+		CacheTTL:    600,
+	}, c, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = h.RequestWithCacheControl("users", "name=test", RequestCacheControl{OnlyIfCached: true})
+	if e := AsError(err); e.StatusCode != http.StatusGatewayTimeout || e.Code != ErrorCodeNotCached {
+		t.Errorf("only-if-cached on miss = %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		cc        RequestCacheControl
+		wantCache bool
+		wantFwd   string
+	}{
+		{"store", RequestCacheControl{}, false, "miss"},
+		{"hit", RequestCacheControl{}, true, ""},
+		{"only-if-cached", RequestCacheControl{OnlyIfCached: true}, true, ""},
+		{"no-cache", RequestCacheControl{NoCache: true}, false, "request"},
+		{"fresh enough", RequestCacheControl{MaxAge: time.Minute}, true, ""},
+	}
+	for _, tt := range tests {
+		status, _, err := h.RequestWithCacheControl("users", "name=test", tt.cc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Hit != tt.wantCache || status.Fwd != tt.wantFwd {
+			t.Errorf("%s: status = %+v, want hit=%v fwd=%s", tt.name, status, tt.wantCache, tt.wantFwd)
+		}
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	status, _, err := h.RequestWithCacheControl("users", "name=test", RequestCacheControl{MaxAge: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Hit || status.Fwd != "stale" {
+		t.Errorf("cache older than max-age should not be used: %+v", status)
+	}
+
+	if requests != 3 {
+		t.Errorf("upstream requests = %d, want 3", requests)
+	}
+}
+
+func Test_upstreamOptions(t *testing.T) {
+	t.Setenv("STNS_AUTH_TOKEN", "env-token")
+	t.Setenv("STNS_REQUEST_RETRY", "5")
+
+	opt, err := upstreamOptions(&Config{AuthToken: "secret", User: "stns", RequestTimeout: 3}, "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &libstns.Options{
+		AuthToken:      "env-token",
+		User:           "stns",
+		UserAgent:      "cache-stnsd/1.0.0",
+		SkipSSLVerify:  true,
+		RequestTimeout: 3,
+		RequestRetry:   5,
+	}
+	if !reflect.DeepEqual(opt, want) {
+		t.Errorf("upstreamOptions() = %+v, want %+v", opt, want)
+	}
+}
+
+func TestHTTPUpstream_SSLVerify(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name      string
+		sslVerify bool
+		wantErr   bool
+	}{
+		{"verify the self-signed certificate", true, true},
+		{"skip verify", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt, err := upstreamOptions(&Config{SSLVerify: tt.sslVerify}, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// don't retry the certificate error
+			opt.RequestRetry = 0
+			u, err := NewHTTPUpstream(ts.URL, opt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := u.Request("users", ""); (err != nil) != tt.wantErr {
+				t.Errorf("Request() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHTTPUpstream_Stream(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(CacheHeader, "HIT")
+		if r.URL.Path == "/users" {
+			w.Write([]byte(`[{"id":1,"name":"test"}]`))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{}`))
+	}))
+	defer ts.Close()
+
+	u, err := NewHTTPUpstream(ts.URL, &libstns.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, body, err := u.Stream("users", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(body)
+	body.Close()
+	if err != nil || string(b) != `[{"id":1,"name":"test"}]` || res.Body != nil {
+		t.Errorf("Stream() body = %s, %v, response body = %s", b, err, res.Body)
+	}
+	if res.Header.Get(UpstreamCacheHeader) != "HIT" || res.Header.Get(CacheHeader) != "" {
+		t.Errorf("Stream() header = %v", res.Header)
+	}
+
+	res, body, err = u.Stream("groups", "")
+	if err == nil || body != nil || res.StatusCode != http.StatusNotFound || string(res.Body) != `{}` {
+		t.Errorf("Stream() of 404 = %v, %v, %v", res, body, err)
+	}
+}
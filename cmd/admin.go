@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/STNS/cache-stnsd/cache_stnsd"
+)
+
+// adminPrefix is the path of the admin API served with the STNS API.
+const adminPrefix = "/_cache-stnsd/"
+
+type healthResponse struct {
+	Status        string                     `json:"status"`
+	Ready         bool                       `json:"ready"`
+	Version       string                     `json:"version"`
+	PrefetchGuard *cache_stnsd.PrefetchGuard `json:"prefetch_guard"`
+}
+
+func newAdminHandler(chttp *cache_stnsd.Http) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(adminPrefix+"health", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			cache_stnsd.WriteError(w, cache_stnsd.NewError(http.StatusMethodNotAllowed, cache_stnsd.ErrorCodeMethodNotAllowed,
+				fmt.Sprintf("method %s is not allowed", r.Method)))
+			return
+		}
+
+		res := healthResponse{
+			Status:        "ok",
+			Ready:         !chttp.Warming(),
+			Version:       chttp.Version(),
+			PrefetchGuard: chttp.PrefetchGuard(),
+		}
+		if res.PrefetchGuard != nil {
+			// not an error for the liveness, restarting loses the previous users and groups
+			res.Status = "prefetch_refused"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !res.Ready {
+			res.Status = "warming"
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(res)
+	})
+
+	mux.HandleFunc(adminPrefix+"prefetch/apply", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			cache_stnsd.WriteError(w, cache_stnsd.NewError(http.StatusMethodNotAllowed, cache_stnsd.ErrorCodeMethodNotAllowed,
+				fmt.Sprintf("method %s is not allowed", r.Method)))
+			return
+		}
+
+		if !isRootPeer(r.Context()) {
+			cache_stnsd.WriteError(w, cache_stnsd.NewError(http.StatusForbidden, cache_stnsd.ErrorCodeForbidden,
+				"only root on the unix socket can apply the prefetch"))
+			return
+		}
+
+		if err := chttp.ApplyPendingPrefetch(); err != nil {
+			cache_stnsd.WriteError(w, cache_stnsd.AsError(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "applied"})
+	})
+
+	mux.HandleFunc(adminPrefix, func(w http.ResponseWriter, r *http.Request) {
+		cache_stnsd.WriteError(w, cache_stnsd.NewError(http.StatusNotFound, cache_stnsd.ErrorCodeNotFound,
+			fmt.Sprintf("%s is not an admin API", r.URL.Path)))
+	})
+	return mux
+}
@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/STNS/cache-stnsd/cache_stnsd"
+)
+
+func TestAdminHandler(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	}))
+	defer ts.Close()
+
+	config := &cache_stnsd.Config{ApiEndpoint: ts.URL, Cache: true, CacheTTL: 600}
+	c := ttlCache(config)
+	defer c.Close()
+	chttp, err := cache_stnsd.NewHttp(config, c, "1.2.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := newServeMux(chttp)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, adminPrefix+"health", nil))
+	res := healthResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || res.Status != "ok" || !res.Ready || res.Version != "1.2.3" || res.PrefetchGuard != nil {
+		t.Errorf("health = %d, %+v", w.Code, res)
+	}
+
+	chttp.SetWarming(true)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, adminPrefix+"health", nil))
+	res = healthResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusServiceUnavailable || res.Status != "warming" || res.Ready {
+		t.Errorf("health while warming = %d, %+v", w.Code, res)
+	}
+	chttp.SetWarming(false)
+
+	tests := []struct {
+		method string
+		target string
+		want   int
+	}{
+		{http.MethodPost, adminPrefix + "health", http.StatusMethodNotAllowed},
+		{http.MethodGet, adminPrefix + "prefetch/apply", http.StatusMethodNotAllowed},
+		// no peer credential over tcp
+		{http.MethodPost, adminPrefix + "prefetch/apply", http.StatusForbidden},
+		{http.MethodGet, adminPrefix + "unknown", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, nil))
+		if w.Code != tt.want {
+			t.Errorf("%s %s = %d, want %d", tt.method, tt.target, w.Code, tt.want)
+		}
+	}
+}
+
+func TestAdminHandlerRoot(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	config := &cache_stnsd.Config{
+		ApiEndpoint: "http://localhost:1104/v1",
+		Cache:       true,
+		CacheTTL:    600,
+		Cached:      cache_stnsd.Cached{UnixSocket: filepath.Join(t.TempDir(), "test.sock")},
+	}
+	closeServer := serveUnix(t, config)
+	defer closeServer()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", config.Cached.UnixSocket)
+		},
+	}}
+	res, err := client.Post("http://unix"+adminPrefix+"prefetch/apply", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusConflict {
+		t.Errorf("apply without pending prefetch = %d, want %d", res.StatusCode, http.StatusConflict)
+	}
+}
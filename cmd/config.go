@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/STNS/cache-stnsd/cache_stnsd"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var secretConfigKeys = []string{
+	"auth_token",
+	"password",
+	"http_headers",
+}
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "check or show the effective config",
+}
+
+var configCheckCmd = &cobra.Command{
+	Use:           "check",
+	Short:         "validate the config as the server loads it",
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, meta, err := loadConfigWithMeta()
+		if err != nil {
+			return fmt.Errorf("config is invalid: %s", err.Error())
+		}
+
+		for _, k := range meta.Undecoded {
+			fmt.Fprintf(cmd.OutOrStdout(), "warning: unknown key %s\n", k)
+		}
+
+		if err := config.Validate(); err != nil {
+			return fmt.Errorf("config is invalid: %s", err.Error())
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "config is valid: %s\n", cfgFile)
+		return nil
+	},
+}
+
+var configShowCmd = &cobra.Command{
+	Use:           "show",
+	Short:         "print the effective config with the source of each value",
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, meta, err := loadConfigWithMeta()
+		if err != nil {
+			return err
+		}
+		writeConfig(cmd.OutOrStdout(), config, meta, overlaySources())
+		return nil
+	},
+}
+
+// configFlags are the flag names of the serverCmd bound to the viper keys in lower case.
+var configFlags = map[string]string{}
+
+func bindConfigFlag(key, name string) {
+	viper.BindPFlag(key, serverCmd.PersistentFlags().Lookup(name))
+	configFlags[strings.ToLower(key)] = name
+}
+
+// overlaySources returns the source of the viper keys in the order viper looks them up.
+// The flags which are not passed are the defaults.
+func overlaySources() map[string]string {
+	sources := map[string]string{}
+	for _, k := range viper.AllKeys() {
+		if name, ok := configFlags[k]; ok && serverCmd.PersistentFlags().Changed(name) {
+			sources[k] = "flag"
+			continue
+		}
+		env := strings.ToUpper("Stnsd_" + k)
+		if _, ok := os.LookupEnv(env); ok {
+			sources[k] = "env " + env
+			continue
+		}
+		sources[k] = "default"
+	}
+	return sources
+}
+
+// writeConfig prints each value as `key = value # source`.
+// The source is "default", the config file, "env NAME" or "flag".
+// overlay is the source of the keys overlaid by viper.
+func writeConfig(w io.Writer, config *cache_stnsd.Config, meta *cache_stnsd.ConfigMeta, overlay map[string]string) {
+	source := func(tomlKey, viperKey string) string {
+		if s, ok := overlay[viperKey]; ok {
+			return s
+		}
+		if f, ok := meta.Sources[tomlKey]; ok {
+			return f
+		}
+		return "default"
+	}
+
+	walkConfig(reflect.ValueOf(config).Elem(), "", "", func(tomlKey, viperKey string, v reflect.Value) {
+		secret := false
+		for _, k := range secretConfigKeys {
+			if tomlKey == k {
+				secret = true
+			}
+		}
+
+		if v.Kind() == reflect.Map {
+			keys := []string{}
+			for _, k := range v.MapKeys() {
+				keys = append(keys, k.String())
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				value := formatConfigValue(v.MapIndex(reflect.ValueOf(k)), secret)
+				fmt.Fprintf(w, "%s.%s = %s # %s\n", tomlKey, k, value, source(tomlKey+"."+k, viperKey))
+			}
+			return
+		}
+		fmt.Fprintf(w, "%s = %s # %s\n", tomlKey, formatConfigValue(v, secret), source(tomlKey, viperKey))
+	})
+}
+
+func walkConfig(v reflect.Value, tomlPrefix, viperPrefix string, fn func(tomlKey, viperKey string, v reflect.Value)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Tag.Get("toml")
+		if name == "" || name == "-" {
+			name = strings.ToLower(f.Name)
+		}
+
+		tomlKey := tomlPrefix + name
+		viperKey := viperPrefix + strings.ToLower(f.Name)
+		if f.Type.Kind() == reflect.Struct {
+			walkConfig(v.Field(i), tomlKey+".", viperKey+".", fn)
+			continue
+		}
+		fn(tomlKey, viperKey, v.Field(i))
+	}
+}
+
+func formatConfigValue(v reflect.Value, secret bool) string {
+	if secret && !v.IsZero() {
+		return `"********"`
+	}
+	var b strings.Builder
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v.Interface()); err != nil {
+		return fmt.Sprintf("%v", v.Interface())
+	}
+	return strings.TrimSpace(b.String())
+}
+
+func init() {
+	configCmd.AddCommand(configCheckCmd)
+	configCmd.AddCommand(configShowCmd)
+	rootCmd.AddCommand(configCmd)
+}
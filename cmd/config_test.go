@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteConfig(t *testing.T) {
+	t.Setenv("STNSD_LOGLEVEL", "debug")
+
+	saved := cfgFile
+	cfgFile = "../cache_stnsd/testdata/full.conf"
+	flags := serverCmd.PersistentFlags()
+	if err := flags.Set("pid-file", "/tmp/cache-stnsd.pid"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cfgFile = saved
+		f := flags.Lookup("pid-file")
+		f.Value.Set(f.DefValue)
+		f.Changed = false
+	})
+
+	config, meta, err := loadConfigWithMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	writeConfig(&b, config, meta, overlaySources())
+
+	for _, want := range []string{
+		`api_endpoint = "http://<server-ip>:1104/v1/" # ../cache_stnsd/testdata/full.conf`,
+		`auth_token = "********" # ../cache_stnsd/testdata/full.conf`,
+		`password = "********" # ../cache_stnsd/testdata/full.conf`,
+		`http_headers.X-API-TOKEN = "********" # ../cache_stnsd/testdata/full.conf`,
+		`cache_ttl = 600 # default`,
+		`tls.cert = "example_cert" # ../cache_stnsd/testdata/full.conf`,
+		`loglevel = "debug" # env STNSD_LOGLEVEL`,
+		`pidfile = "/tmp/cache-stnsd.pid" # flag`,
+		`logfile = "/var/log/cache-stnsd.log" # default`,
+		`cached.unix_socket = "/var/run/cache-stnsd.sock" # default`,
+	} {
+		if !strings.Contains(b.String(), want+"\n") {
+			t.Errorf("missing %q in:\n%s", want, b.String())
+		}
+	}
+
+	if strings.Contains(b.String(), "xxxxxxxxxxxxxxx") || strings.Contains(b.String(), "test_password") {
+		t.Errorf("secret is not masked:\n%s", b.String())
+	}
+}
@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+type peerCredKey struct{}
+
+// peerCredContext stores the credential of the process connected to the unix socket.
+// It is used as http.Server.ConnContext.
+func peerCredContext(ctx context.Context, c net.Conn) context.Context {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return ctx
+	}
+
+	var cred *syscall.Ucred
+	raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || cred == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, peerCredKey{}, cred)
+}
+
+// peerCred returns the credential stored by peerCredContext.
+// It returns nil for tcp connections.
+func peerCred(ctx context.Context) *syscall.Ucred {
+	cred, _ := ctx.Value(peerCredKey{}).(*syscall.Ucred)
+	return cred
+}
+
+// isRootPeer reports whether the client is a process of root.
+func isRootPeer(ctx context.Context) bool {
+	cred := peerCred(ctx)
+	return cred != nil && cred.Uid == 0
+}
@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPeerCredContext(t *testing.T) {
+	dir := t.TempDir()
+	l, err := net.Listen("unix", filepath.Join(dir, "test.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		c, err := net.Dial("unix", l.Addr().String())
+		if err == nil {
+			defer c.Close()
+			c.Read(make([]byte, 1))
+		}
+	}()
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	cred := peerCred(peerCredContext(context.Background(), c))
+	if cred == nil {
+		t.Fatal("credential should be stored")
+	}
+	if int(cred.Uid) != os.Getuid() || int(cred.Pid) != os.Getpid() {
+		t.Errorf("credential = %+v", cred)
+	}
+	if isRootPeer(context.Background()) {
+		t.Error("connection without credential should not be root")
+	}
+}
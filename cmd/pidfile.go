@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// pidFile is a pid file locked exclusively while the server is running.
+type pidFile struct {
+	path string
+	f    *os.File
+}
+
+func lockPidfile(path string) (*pidFile, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		defer f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			b := make([]byte, 32)
+			n, _ := f.Read(b)
+			return nil, fmt.Errorf("another cache-stnsd is already running: pid=%s pidfile=%s", strings.TrimSpace(string(b[:n])), path)
+		}
+		return nil, err
+	}
+
+	p := &pidFile{path: path, f: f}
+	if err := p.write(os.Getpid()); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// write replaces the pid in the file.
+func (p *pidFile) write(pid int) error {
+	if err := p.f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := p.f.WriteAt([]byte(strconv.Itoa(pid)+"\n"), 0)
+	return err
+}
+
+// Remove removes the pid file and releases the lock.
+func (p *pidFile) Remove() error {
+	defer p.f.Close()
+	return os.Remove(p.path)
+}
+
+// Close releases the file without removing it, for the new process that took it over.
+func (p *pidFile) Close() error {
+	return p.f.Close()
+}
+
+// checkStaleSocket returns an error if another process accepts connections on the socket.
+// Otherwise a remaining socket file is removed.
+func checkStaleSocket(sf string) error {
+	if !Exists(sf) {
+		return nil
+	}
+
+	conn, err := net.DialTimeout("unix", sf, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is already served by another process", sf)
+	}
+	return os.Remove(sf)
+}
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestLockPidfile(t *testing.T) {
+	dir, err := os.MkdirTemp("", "stnsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cache-stnsd.pid")
+	p, err := lockPidfile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(b)) != strconv.Itoa(os.Getpid()) {
+		t.Errorf("pidfile = %s, want %d", b, os.Getpid())
+	}
+
+	if _, err := lockPidfile(path); err == nil {
+		t.Error("second lock should fail")
+	}
+
+	if err := p.Remove(); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err = lockPidfile(path)
+	if err != nil {
+		t.Fatalf("lock after remove failed: %s", err)
+	}
+	p.Remove()
+}
+
+func TestCheckStaleSocket(t *testing.T) {
+	dir, err := os.MkdirTemp("", "stnsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sf := filepath.Join(dir, "cache-stnsd.sock")
+	if err := checkStaleSocket(sf); err != nil {
+		t.Errorf("checkStaleSocket() for missing socket = %v", err)
+	}
+
+	l, err := net.Listen("unix", sf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkStaleSocket(sf); err == nil {
+		t.Error("checkStaleSocket() should fail for a served socket")
+	}
+
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	if err := checkStaleSocket(sf); err != nil {
+		t.Errorf("checkStaleSocket() for stale socket = %v", err)
+	}
+	if Exists(sf) {
+		t.Error("stale socket should be removed")
+	}
+}
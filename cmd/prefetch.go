@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/STNS/cache-stnsd/cache_stnsd"
+	"github.com/sirupsen/logrus"
+)
+
+// prefetchDelay returns the time until the next prefetch.
+// After failures, the retry starts from PrefetchRetryBase and is doubled for each consecutive failure
+// up to the max backoff, and random jitter is added so that hosts don't prefetch at the same time.
+func prefetchDelay(config *cache_stnsd.Config, failures int, random func(int64) int64) time.Duration {
+	delay := config.PrefetchPeriod()
+	if failures > 0 {
+		max := config.PrefetchBackoff()
+		delay = cache_stnsd.PrefetchRetryBase
+		for i := 1; i < failures && delay < max; i++ {
+			delay *= 2
+		}
+		if delay > max {
+			delay = max
+		}
+	}
+
+	if jitter := time.Duration(config.Cached.PrefetchJitter) * time.Second; jitter > 0 {
+		delay += time.Duration(random(int64(jitter)))
+	}
+	return delay
+}
+
+// runPrefetch prefetches users and groups right away and then periodically until ctx is done.
+// warmed is closed after the first prefetch.
+func runPrefetch(ctx context.Context, chttp *cache_stnsd.Http, warmed chan<- struct{}) {
+	failures := 0
+	for {
+		if err := chttp.PrefetchUserGroups(); err != nil {
+			failures++
+		} else {
+			failures = 0
+		}
+
+		if warmed != nil {
+			close(warmed)
+			warmed = nil
+		}
+
+		delay := prefetchDelay(chttp.Config(), failures, rand.Int63n)
+		if failures > 0 {
+			logrus.Warnf("prefetch failed %d times, retry in %s", failures, delay)
+		}
+
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/STNS/cache-stnsd/cache_stnsd"
+)
+
+func Test_prefetchDelay(t *testing.T) {
+	noRandom := func(n int64) int64 { return 0 }
+	maxRandom := func(n int64) int64 { return n - 1 }
+
+	tests := []struct {
+		name     string
+		cacheTTL int
+		cached   cache_stnsd.Cached
+		failures int
+		random   func(int64) int64
+		want     time.Duration
+	}{
+		{"half of cache_ttl", 600, cache_stnsd.Cached{}, 0, noRandom, 300 * time.Second},
+		{"short cache_ttl", 1, cache_stnsd.Cached{}, 0, noRandom, cache_stnsd.MinPrefetchInterval},
+		{"interval", 600, cache_stnsd.Cached{PrefetchInterval: 60}, 0, noRandom, 60 * time.Second},
+		{"jitter", 600, cache_stnsd.Cached{PrefetchInterval: 60, PrefetchJitter: 10}, 0, maxRandom, 70*time.Second - 1},
+		{"first retry", 600, cache_stnsd.Cached{}, 1, noRandom, cache_stnsd.PrefetchRetryBase},
+		{"backoff", 600, cache_stnsd.Cached{PrefetchInterval: 60}, 3, noRandom, 4 * cache_stnsd.PrefetchRetryBase},
+		{"default max backoff", 600, cache_stnsd.Cached{}, 20, noRandom, 300 * time.Second},
+		{"max backoff", 600, cache_stnsd.Cached{PrefetchInterval: 60, PrefetchMaxBackoff: 100}, 20, noRandom, 100 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &cache_stnsd.Config{CacheTTL: tt.cacheTTL, Cached: tt.cached}
+			if got := prefetchDelay(config, tt.failures, tt.random); got != tt.want {
+				t.Errorf("prefetchDelay() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_runPrefetch(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`[]`))
+	}))
+	defer ts.Close()
+
+	config := &cache_stnsd.Config{ApiEndpoint: ts.URL, Cache: true, CacheTTL: 600}
+	c := ttlCache(config)
+	defer c.Close()
+	chttp, err := cache_stnsd.NewHttp(config, c, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	warmed := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		runPrefetch(ctx, chttp, warmed)
+		close(done)
+	}()
+
+	select {
+	case <-warmed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("first prefetch should run at startup")
+	}
+	if requests != 2 {
+		t.Errorf("upstream requests = %d, want 2", requests)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("prefetch should stop when the context is done")
+	}
+}
@@ -17,16 +17,18 @@ package cmd
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/ReneKroon/ttlcache/v2"
 	"github.com/STNS/cache-stnsd/cache_stnsd"
-	"github.com/facebookgo/pidfile"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -41,40 +43,115 @@ var serverCmd = &cobra.Command{
 you can set runing config to /etc/stns/client/stns.conf.
 	`,
 	Run: func(cmd *cobra.Command, args []string) {
-		var config *cache_stnsd.Config
-		viper.SetEnvPrefix("Stnsd")
-		viper.AutomaticEnv()
-		config, err := cache_stnsd.LoadConfig(cfgFile)
+		config, err := loadConfig()
 		if err != nil {
 			logrus.Fatal(err)
 		}
-		if err := viper.Unmarshal(config); err != nil {
+
+		if err := setupLogger(config); err != nil {
 			logrus.Fatal(err)
 		}
 
-		if config.LogFile != "" {
-			f, err := os.OpenFile(config.LogFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
-			if err != nil {
-				logrus.Fatal("error opening file :" + err.Error())
-			}
-			logrus.SetOutput(f)
+		if err := runServer(config); err != nil {
+			logrus.Fatal(err)
 		}
+	},
+}
 
-		switch config.LogLevel {
-		case "debug":
-			logrus.SetLevel(logrus.DebugLevel)
-		case "info":
-			logrus.SetLevel(logrus.InfoLevel)
-		case "warn":
-			logrus.SetLevel(logrus.WarnLevel)
-		case "error":
-			logrus.SetLevel(logrus.ErrorLevel)
+// loadConfig reads the config file and overlays flags and STNSD_ environment variables.
+func loadConfig() (*cache_stnsd.Config, error) {
+	config, _, err := loadConfigWithMeta()
+	if err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+var logFile *os.File
+
+func loadConfigWithMeta() (*cache_stnsd.Config, *cache_stnsd.ConfigMeta, error) {
+	viper.SetEnvPrefix("Stnsd")
+	viper.AutomaticEnv()
+	config, meta, err := cache_stnsd.LoadConfigWithMeta(cfgFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := viper.Unmarshal(config); err != nil {
+		return nil, nil, err
+	}
+	return config, meta, nil
+}
+
+func setupLogger(config *cache_stnsd.Config) error {
+	if config.LogFile != "" {
+		f, err := os.OpenFile(config.LogFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("error opening file :%s", err.Error())
+		}
+		logrus.SetOutput(f)
+		if logFile != nil {
+			logFile.Close()
 		}
+		logFile = f
+	}
 
-		if err := runServer(config); err != nil {
-			logrus.Fatal(err)
+	switch config.LogLevel {
+	case "debug":
+		logrus.SetLevel(logrus.DebugLevel)
+	case "info":
+		logrus.SetLevel(logrus.InfoLevel)
+	case "warn":
+		logrus.SetLevel(logrus.WarnLevel)
+	case "error":
+		logrus.SetLevel(logrus.ErrorLevel)
+	}
+	return nil
+}
+
+// reloadServer applies a new config to the running server.
+// The listener and the cache are kept, so settings bound to them can't be changed.
+func reloadServer(chttp *cache_stnsd.Http) error {
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	keepStartupConfig(config, chttp.Config())
+	// the kept values may not be valid with the new config, such as authoritative without prefetch
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	if err := chttp.Reload(config); err != nil {
+		return err
+	}
+	return setupLogger(config)
+}
+
+// keepStartupConfig keeps the values bound to the listeners and to the goroutines started once,
+// which can't be changed by reload.
+func keepStartupConfig(config, current *cache_stnsd.Config) {
+	keep := func(name string, changed bool, value interface{}, restore func()) {
+		if changed {
+			logrus.Warnf("%s can't be changed by reload, keep %v", name, value)
+			restore()
 		}
-	},
+	}
+
+	c, cur := &config.Cached, current.Cached
+	keep("unix_socket", c.UnixSocket != cur.UnixSocket, cur.UnixSocket, func() { c.UnixSocket = cur.UnixSocket })
+	keep("pid file", config.PIDFile != current.PIDFile, current.PIDFile, func() { config.PIDFile = current.PIDFile })
+	keep("socket_mode", c.SocketMode != cur.SocketMode, cur.SocketMode, func() { c.SocketMode = cur.SocketMode })
+	keep("socket_owner", c.SocketOwner != cur.SocketOwner, cur.SocketOwner, func() { c.SocketOwner = cur.SocketOwner })
+	keep("socket_group", c.SocketGroup != cur.SocketGroup, cur.SocketGroup, func() { c.SocketGroup = cur.SocketGroup })
+	keep("listen", c.Listen != cur.Listen, cur.Listen, func() { c.Listen = cur.Listen })
+	keep("[cached.tls]", c.TLS != cur.TLS, cur.TLS, func() { c.TLS = cur.TLS })
+	keep("prefetch", c.Prefetch != cur.Prefetch, cur.Prefetch, func() { c.Prefetch = cur.Prefetch })
+	keep("warmup", c.Warmup != cur.Warmup, cur.Warmup, func() { c.Warmup = cur.Warmup })
+	keep("ready_timeout", c.ReadyTimeout != cur.ReadyTimeout, cur.ReadyTimeout, func() { c.ReadyTimeout = cur.ReadyTimeout })
 }
 
 func ttlCache(config *cache_stnsd.Config) *ttlcache.Cache {
@@ -88,35 +165,188 @@ func Exists(name string) bool {
 	return !os.IsNotExist(err)
 }
 
-func runServer(config *cache_stnsd.Config) error {
-	sf := config.Cached.UnixSocket
-	pidfile.SetPidfilePath(config.PIDFile)
+func newServeMux(chttp *cache_stnsd.Http) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle(adminPrefix, newAdminHandler(chttp))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		cached := chttp.Config().Cached
+		setVersionHeader(w, chttp.Version())
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			cache_stnsd.WriteError(w, cache_stnsd.NewError(http.StatusMethodNotAllowed, cache_stnsd.ErrorCodeMethodNotAllowed,
+				fmt.Sprintf("method %s is not allowed", r.Method)))
+			return
+		}
 
-	if Exists(sf) {
-		if err := os.Remove(sf); err != nil {
-			return err
+		if cached.MaxQueryLength > 0 && len(r.URL.RawQuery) > cached.MaxQueryLength {
+			cache_stnsd.WriteError(w, cache_stnsd.NewError(http.StatusRequestURITooLong, cache_stnsd.ErrorCodeQueryTooLong,
+				fmt.Sprintf("query is longer than %d", cached.MaxQueryLength)))
+			return
+		}
+
+		if !cached.AllowPath(r.URL.Path) {
+			cache_stnsd.WriteError(w, cache_stnsd.NewError(http.StatusNotFound, cache_stnsd.ErrorCodeNotFound,
+				fmt.Sprintf("%s is not a STNS resource", r.URL.Path)))
+			return
+		}
+
+		cc := cache_stnsd.ParseRequestCacheControl(r.Header)
+		if cc.Bypass() && cached.BypassRootOnly && !isRootPeer(r.Context()) {
+			logrus.Debugf("ignore cache bypass from non-root client: %s", r.URL)
+			cc.NoCache = false
+			cc.MaxAge = 0
+		}
+
+		status, resp, err := chttp.RequestWithCacheControl(r.URL.Path, r.URL.RawQuery, cc)
+		if err != nil {
+			w.Header().Set("Cache-Status", status.String())
+			w.Header().Set(cache_stnsd.CacheHeader, "0")
+			cache_stnsd.WriteError(w, cache_stnsd.AsError(err))
+			return
 		}
+
+		for k, vv := range resp.Header {
+			w.Header()[k] = append([]string(nil), vv...)
+		}
+
+		// the entry of this process follows the ones of upstream caches
+		w.Header().Add("Cache-Status", status.String())
+		// headers of this process win over the ones stored from upstream
+		setVersionHeader(w, chttp.Version())
+		w.Header().Set(cache_stnsd.CacheHeader, "0")
+		if status.Hit {
+			w.Header().Set(cache_stnsd.CacheHeader, "1")
+			w.Header().Set("Age", strconv.FormatInt(int64(status.Age/time.Second), 10))
+		}
+
+		w.WriteHeader(resp.StatusCode)
+		w.Write(resp.Body)
+	})
+
+	return mux
+}
+
+func setVersionHeader(w http.ResponseWriter, version string) {
+	w.Header().Set("Server", cache_stnsd.ProductName(version))
+	if version != "" {
+		w.Header().Set(cache_stnsd.VersionHeader, version)
 	}
+}
+
+// waitWarmed waits until the cache is warmed by the first prefetch, or ready_timeout seconds.
+func waitWarmed(warmed <-chan struct{}, timeout int) {
+	select {
+	case <-warmed:
+	case <-time.After(time.Duration(timeout) * time.Second):
+		logrus.Warnf("cache is not warmed in %d seconds", timeout)
+	}
+}
+
+// notifyReady sends READY=1 to systemd after the warm up.
+func notifyReady(ready <-chan struct{}) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+
+	<-ready
+	if err := sdNotify("READY=1"); err != nil {
+		logrus.Errorf("notify ready failed: %s", err)
+	}
+}
 
-	unixListener, err := net.Listen("unix", sf)
+// checkAlive makes sure the socket accepts connections and the cache is not locked.
+func checkAlive(socket string, cache *ttlcache.Cache) error {
+	conn, err := net.DialTimeout("unix", socket, time.Second)
 	if err != nil {
 		return err
 	}
+	conn.Close()
 
-	if err := os.Chmod(sf, 0777); err != nil {
-		return err
+	done := make(chan struct{})
+	go func() {
+		cache.Count()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(time.Second):
+		return fmt.Errorf("cache is not responding")
 	}
+}
 
-	if err := pidfile.Write(); err != nil {
+func runServer(config *cache_stnsd.Config) error {
+	sf := config.Cached.UnixSocket
+	var handedOver atomic.Bool
+
+	up, err := inheritUpgrade(config.PIDFile)
+	if err != nil {
 		return err
 	}
 
+	var pid *pidFile
+	var unixListener, tcpListener net.Listener
+	unlinkSocket := false
+	if up != nil {
+		logrus.Info("take over the socket from the old process")
+		pid = up.pid
+		unixListener = up.listener
+		tcpListener = up.tcpListener
+		unlinkSocket = up.unlinkSocket
+	} else {
+		pid, err = lockPidfile(config.PIDFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	defer func() {
+		if handedOver.Load() {
+			pid.Close()
+			return
+		}
+		if err := pid.Remove(); err != nil {
+			logrus.Errorf("Error removing %s: %s", config.PIDFile, err)
+		}
+	}()
+
+	if unixListener == nil {
+		unixListener, err = systemdListener()
+		if err != nil {
+			return err
+		}
+		if unixListener != nil {
+			logrus.Infof("use the socket passed by systemd: %s", unixListener.Addr())
+		}
+	}
+
+	if unixListener == nil {
+		if err := checkStaleSocket(sf); err != nil {
+			return err
+		}
+
+		unixListener, err = listenUnix(config.Cached)
+		if err != nil {
+			return err
+		}
+		unlinkSocket = true
+	}
+
 	defer func() {
-		if err := os.Remove(pidfile.GetPidfilePath()); err != nil {
-			logrus.Errorf("Error removing %s: %s", pidfile.GetPidfilePath(), err)
+		if unlinkSocket && !handedOver.Load() {
+			os.Remove(sf)
 		}
 	}()
 
+	var tcpServeListener net.Listener
+	if config.Cached.Listen != "" {
+		tcpListener, tcpServeListener, err = listenTCP(config.Cached, tcpListener)
+		if err != nil {
+			return err
+		}
+	}
+
 	cache := ttlCache(config)
 	defer cache.Close()
 
@@ -128,48 +358,52 @@ func runServer(config *cache_stnsd.Config) error {
 	if err != nil {
 		return err
 	}
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("STNSD-CACHE", "0")
-		isCache, resp, err := chttp.Request(r.URL.Path, r.URL.RawQuery)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
-		if isCache {
-			w.Header().Set("STNSD-CACHE", "1")
-		}
-
-		if len(resp.Headers) > 0 {
-			for k, vv := range resp.Headers {
-				w.Header().Set(k, vv)
-			}
-		}
-
-		w.WriteHeader(resp.StatusCode)
-		if resp.StatusCode == http.StatusOK {
-			w.Write(resp.Body)
-		}
-	})
-
 	server := http.Server{
-		Handler: mux,
+		Handler:     newServeMux(chttp),
+		ConnContext: peerCredContext,
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	if up != nil {
+		up.restore(chttp)
+	}
+
+	warmed := make(chan struct{})
 	if config.Cache && config.Cached.Prefetch {
+		go runPrefetch(ctx, chttp, warmed)
+	} else {
+		close(warmed)
+	}
+
+	// the snapshot of the old process is already restored
+	chttp.SetWarming(true)
+	ready := make(chan struct{})
+	go func() {
+		waitWarmed(warmed, config.Cached.ReadyTimeout)
+		chttp.SetWarming(false)
+		close(ready)
+	}()
+	go notifyReady(ready)
+
+	if interval := watchdogInterval(); interval > 0 {
+		// the socket created by this process is bound on a temporary path and renamed
+		socket := unixListener.Addr().String()
+		if unlinkSocket {
+			socket = sf
+		}
 		go func() {
-			t := time.NewTicker(time.Duration(config.CacheTTL/2) * time.Second)
-			defer func() {
-				t.Stop()
-			}()
+			t := time.NewTicker(interval)
+			defer t.Stop()
 			for {
 				select {
 				case <-t.C:
-					chttp.PrefetchUserGroups()
+					if err := checkAlive(socket, cache); err != nil {
+						logrus.Errorf("liveness check failed: %s", err)
+						continue
+					}
+					sdNotify("WATCHDOG=1")
 				case <-ctx.Done():
 					return
 				}
@@ -177,10 +411,40 @@ func runServer(config *cache_stnsd.Config) error {
 		}()
 	}
 
+	shutdown := make(chan struct{})
 	go func() {
-		quit := make(chan os.Signal)
-		signal.Notify(quit, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGINT)
-		<-quit
+		defer close(shutdown)
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR2)
+		for sig := range quit {
+			if sig == syscall.SIGHUP {
+				logrus.Info("reloading config")
+				sdNotify("RELOADING=1")
+				if err := reloadServer(chttp); err != nil {
+					logrus.Errorf("reload config failed, keep current config: %s", err)
+				} else {
+					logrus.Info("reloaded config")
+				}
+				sdNotify("READY=1")
+				continue
+			}
+
+			if sig == syscall.SIGUSR2 {
+				logrus.Info("starting upgrade")
+				p, err := startUpgrade(unixListener, tcpListener, pid, chttp, unlinkSocket)
+				if err != nil {
+					logrus.Errorf("upgrade failed, keep running: %s", err)
+					continue
+				}
+				handedOver.Store(true)
+				sdNotify(fmt.Sprintf("MAINPID=%d", p.Pid))
+				logrus.Infof("handed over to the new process: pid=%d", p.Pid)
+				break
+			}
+
+			sdNotify("STOPPING=1")
+			break
+		}
 		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 		defer cancel()
 		logrus.Info("starting shutdown stnsd")
@@ -188,12 +452,28 @@ func runServer(config *cache_stnsd.Config) error {
 			logrus.Errorf("shutting down the server: %s", err)
 		}
 	}()
-	defer os.Remove(sf)
+	if config.Cached.Warmup == cache_stnsd.WarmupBlock {
+		// connections wait in the backlog of the listener
+		logrus.Info("warming up the cache before serving")
+		<-ready
+	}
+
+	if tcpServeListener != nil {
+		go func() {
+			logrus.Infof("starting cache-stnsd on %s", config.Cached.Listen)
+			if err := server.Serve(tcpServeListener); err != nil && err != http.ErrServerClosed {
+				logrus.Error(err)
+			}
+		}()
+	}
+
 	logrus.Info("starting cache-stnsd")
 	if err := server.Serve(unixListener); err != nil {
-		if err.Error() != "http: Server closed" {
+		if err != http.ErrServerClosed {
 			logrus.Error(err)
 		} else {
+			// wait until the active connections are drained
+			<-shutdown
 			logrus.Info("shutdown cache-stnsd")
 		}
 	}
@@ -204,16 +484,16 @@ func runServer(config *cache_stnsd.Config) error {
 
 func init() {
 	serverCmd.PersistentFlags().StringP("unix-socket", "s", "/var/run/cache-stnsd.sock", "unix domain socket file(Env:STNSD_UNIX_SOCKET)")
-	viper.BindPFlag("Cached.UnixSocket", serverCmd.PersistentFlags().Lookup("unix-socket"))
+	bindConfigFlag("Cached.UnixSocket", "unix-socket")
 
 	serverCmd.PersistentFlags().StringP("pid-file", "p", "/run/cache-stnsd.pid", "pid file")
-	viper.BindPFlag("PIDFile", serverCmd.PersistentFlags().Lookup("pid-file"))
+	bindConfigFlag("PIDFile", "pid-file")
 
 	serverCmd.PersistentFlags().StringP("log-file", "l", "/var/log/cache-stnsd.log", "log file")
-	viper.BindPFlag("LogFile", serverCmd.PersistentFlags().Lookup("log-file"))
+	bindConfigFlag("LogFile", "log-file")
 
 	serverCmd.PersistentFlags().String("log-level", "info", "log level(debug,info,warn,error)")
-	viper.BindPFlag("LogLevel", serverCmd.PersistentFlags().Lookup("log-level"))
+	bindConfigFlag("LogLevel", "log-level")
 
 	rootCmd.AddCommand(serverCmd)
 }
@@ -1,8 +1,15 @@
 package cmd
 
 import (
+	"context"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -34,7 +41,7 @@ func TestEnableCacheWhenServerDown(t *testing.T) {
 	}))
 	defer ts.Close()
 
-	s, _ := libstns.NewSTNS(ts.URL, &libstns.Options{})
+	s, _ := cache_stnsd.NewHTTPUpstream(ts.URL, &libstns.Options{})
 	cache_stnsd.SetExpirationCallback(s, c)
 
 	key = "example2"
@@ -48,3 +55,362 @@ func TestEnableCacheWhenServerDown(t *testing.T) {
 		t.Fatal("couldn't use cache when server down")
 	}
 }
+
+func serveUnix(t *testing.T, config *cache_stnsd.Config) func() {
+	c := ttlCache(config)
+	chttp, err := cache_stnsd.NewHttp(config, c, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("unix", config.Cached.UnixSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &http.Server{Handler: newServeMux(chttp), ConnContext: peerCredContext}
+	go server.Serve(l)
+	return func() {
+		server.Close()
+		c.Close()
+	}
+}
+
+func TestChainServer(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("User-Highest-Id", "10")
+		w.Write([]byte(`[{"id":1,"name":"test"}]`))
+	}))
+	defer ts.Close()
+
+	dir, err := os.MkdirTemp("", "stnsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	parentSock := filepath.Join(dir, "parent.sock")
+	childSock := filepath.Join(dir, "child.sock")
+
+	closeParent := serveUnix(t, &cache_stnsd.Config{
+		ApiEndpoint: ts.URL,
+		Cache:       true,
+		CacheTTL:    600,
+		Cached:      cache_stnsd.Cached{UnixSocket: parentSock},
+	})
+	defer closeParent()
+
+	childConfig := &cache_stnsd.Config{
+		ApiEndpoint: "unix://" + parentSock,
+		Cache:       true,
+		CacheTTL:    600,
+		Cached:      cache_stnsd.Cached{UnixSocket: childSock},
+	}
+	closeChild := serveUnix(t, childConfig)
+	defer closeChild()
+
+	get := func(sock string) *http.Response {
+		client := http.Client{
+			Transport: &http.Transport{
+				DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+					return net.Dial("unix", sock)
+				},
+				DisableKeepAlives: true,
+			},
+		}
+		res, err := client.Get("http://unix/users?name=test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != `[{"id":1,"name":"test"}]` {
+			t.Errorf("unexpected body: %s", body)
+		}
+		return res
+	}
+
+	res := get(childSock)
+	if res.Header.Get("STNSD-CACHE") != "0" || res.Header.Get("STNSD-UPSTREAM-CACHE") != "0" {
+		t.Errorf("first request should miss both caches: %v", res.Header)
+	}
+	if res.Header.Get("User-Highest-Id") != "10" {
+		t.Errorf("id header was not forwarded: %v", res.Header)
+	}
+
+	res = get(childSock)
+	if res.Header.Get("STNSD-CACHE") != "1" {
+		t.Errorf("second request should hit child cache: %v", res.Header)
+	}
+
+	// a second child sharing the same parent is served from the parent's cache
+	childConfig.Cached.UnixSocket = filepath.Join(dir, "child2.sock")
+	closeChild2 := serveUnix(t, childConfig)
+	defer closeChild2()
+
+	res = get(childConfig.Cached.UnixSocket)
+	if res.Header.Get("STNSD-CACHE") != "0" || res.Header.Get("STNSD-UPSTREAM-CACHE") != "1" {
+		t.Errorf("request should hit parent cache: %v", res.Header)
+	}
+	if cs := res.Header.Values("Cache-Status"); len(cs) != 2 ||
+		!strings.HasPrefix(cs[0], "cache-stnsd; hit") || !strings.HasPrefix(cs[1], "cache-stnsd; fwd=miss") {
+		t.Errorf("Cache-Status should list the parent and the child: %v", cs)
+	}
+
+	if requests != 1 {
+		t.Errorf("upstream requests = %d, want 1", requests)
+	}
+}
+
+func TestServeMuxPolicy(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`[]`))
+	}))
+	defer ts.Close()
+
+	config := &cache_stnsd.Config{
+		ApiEndpoint: ts.URL,
+		Cache:       true,
+		CacheTTL:    600,
+		Cached: cache_stnsd.Cached{
+			AllowPaths:     []string{"extra"},
+			MaxQueryLength: 16,
+		},
+	}
+	c := ttlCache(config)
+	defer c.Close()
+	chttp, err := cache_stnsd.NewHttp(config, c, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := newServeMux(chttp)
+
+	tests := []struct {
+		method string
+		target string
+		want   int
+	}{
+		{http.MethodGet, "/users?name=test", http.StatusOK},
+		{http.MethodHead, "/groups", http.StatusOK},
+		{http.MethodGet, "/extra", http.StatusOK},
+		{http.MethodGet, "/get?a=b", http.StatusNotFound},
+		{http.MethodPost, "/users", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/users?name=aaaaaaaaaaaaaaaaaaaa", http.StatusRequestURITooLong},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, nil))
+		if w.Code != tt.want {
+			t.Errorf("%s %s = %d, want %d", tt.method, tt.target, w.Code, tt.want)
+		}
+	}
+
+	if requests != 3 {
+		t.Errorf("upstream requests = %d, want 3", requests)
+	}
+}
+
+func TestServeMuxErrorBody(t *testing.T) {
+	config := &cache_stnsd.Config{
+		ApiEndpoint:    "http://localhost:1104/v1",
+		QueryWrapper:   "../cache_stnsd/testdata/query_wrapper.sh",
+		RequestTimeout: 1,
+		Cache:          true,
+		CacheTTL:       600,
+		Cached: cache_stnsd.Cached{
+			AllowPaths: []string{"error", "sleep"},
+		},
+	}
+	c := ttlCache(config)
+	defer c.Close()
+	chttp, err := cache_stnsd.NewHttp(config, c, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := newServeMux(chttp)
+
+	tests := []struct {
+		target   string
+		want     int
+		wantBody string
+	}{
+		{"/users?name=notfound", http.StatusNotFound, ""},
+		{"/error", http.StatusInternalServerError, `{"error":"wrapper"}`},
+		{"/sleep", http.StatusGatewayTimeout, `"code":"upstream_timeout"`},
+		{"/get", http.StatusNotFound, `"code":"not_found"`},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+		if w.Code != tt.want {
+			t.Errorf("GET %s = %d, want %d", tt.target, w.Code, tt.want)
+		}
+		if !strings.Contains(w.Body.String(), tt.wantBody) {
+			t.Errorf("GET %s body = %s, want %s", tt.target, w.Body.String(), tt.wantBody)
+		}
+	}
+}
+
+func TestServeMuxCacheBypass(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`[]`))
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name           string
+		bypassRootOnly bool
+		cacheControl   string
+		want           int
+		wantRequests   int
+	}{
+		{"no-cache", false, "no-cache", http.StatusOK, 2},
+		{"max-age=0", false, "max-age=0", http.StatusOK, 2},
+		{"only-if-cached", false, "only-if-cached", http.StatusOK, 1},
+		{"ignored without peer credential", true, "no-cache", http.StatusOK, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests = 0
+			config := &cache_stnsd.Config{
+				ApiEndpoint: ts.URL,
+				Cache:       true,
+				CacheTTL:    600,
+				Cached: cache_stnsd.Cached{
+					BypassRootOnly: tt.bypassRootOnly,
+				},
+			}
+			c := ttlCache(config)
+			defer c.Close()
+			chttp, err := cache_stnsd.NewHttp(config, c, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			mux := newServeMux(chttp)
+
+			mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users?name=test", nil))
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/users?name=test", nil)
+			r.Header.Set("Cache-Control", tt.cacheControl)
+			mux.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+			if requests != tt.wantRequests {
+				t.Errorf("upstream requests = %d, want %d", requests, tt.wantRequests)
+			}
+		})
+	}
+
+	config := &cache_stnsd.Config{ApiEndpoint: ts.URL, Cache: true, CacheTTL: 600}
+	c := ttlCache(config)
+	defer c.Close()
+	chttp, err := cache_stnsd.NewHttp(config, c, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/users?name=miss", nil)
+	r.Header.Set("Cache-Control", "only-if-cached")
+	newServeMux(chttp).ServeHTTP(w, r)
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("only-if-cached on miss = %d, want %d", w.Code, http.StatusGatewayTimeout)
+	}
+}
+
+func TestServeMuxResponseHeaders(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "stns")
+		w.Write([]byte(`[]`))
+	}))
+	defer ts.Close()
+
+	config := &cache_stnsd.Config{ApiEndpoint: ts.URL, Cache: true, CacheTTL: 600}
+	c := ttlCache(config)
+	defer c.Close()
+	chttp, err := cache_stnsd.NewHttp(config, c, "1.2.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := newServeMux(chttp)
+
+	tests := []struct {
+		cacheHeader string
+		cacheStatus string
+		age         string
+	}{
+		{"0", "cache-stnsd; fwd=miss; fwd-status=200; stored; ttl=600", ""},
+		{"1", "cache-stnsd; hit; ttl=", "0"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users?name=test", nil))
+		h := w.Header()
+		if h.Get(cache_stnsd.CacheHeader) != tt.cacheHeader {
+			t.Errorf("%s = %s, want %s", cache_stnsd.CacheHeader, h.Get(cache_stnsd.CacheHeader), tt.cacheHeader)
+		}
+		if !strings.HasPrefix(h.Get("Cache-Status"), tt.cacheStatus) {
+			t.Errorf("Cache-Status = %s, want %s", h.Get("Cache-Status"), tt.cacheStatus)
+		}
+		if h.Get("Age") != tt.age {
+			t.Errorf("Age = %s, want %s", h.Get("Age"), tt.age)
+		}
+		if h.Get("Server") != "cache-stnsd/1.2.3" || h.Get(cache_stnsd.VersionHeader) != "1.2.3" {
+			t.Errorf("Server = %s, %s = %s", h.Get("Server"), cache_stnsd.VersionHeader, h.Get(cache_stnsd.VersionHeader))
+		}
+	}
+}
+
+func Test_keepStartupConfig(t *testing.T) {
+	current := &cache_stnsd.Config{
+		ApiEndpoint: "http://localhost:1104/v1",
+		Cache:       true,
+		CacheTTL:    600,
+		PIDFile:     "/var/run/cache-stnsd.pid",
+		Cached: cache_stnsd.Cached{
+			UnixSocket: "/var/run/cache-stnsd.sock",
+			SocketMode: "0666",
+			Listen:     "127.0.0.1:1105",
+			Warmup:     cache_stnsd.WarmupBlock,
+		},
+	}
+
+	config := *current
+	config.CacheTTL = 300
+	config.PIDFile = "/tmp/cache-stnsd.pid"
+	config.Cached = cache_stnsd.Cached{
+		UnixSocket:    "/tmp/cache-stnsd.sock",
+		SocketMode:    "0660",
+		SocketGroup:   "stns",
+		Listen:        "127.0.0.1:1106",
+		TLS:           libstns.TLS{Cert: "server.crt", Key: "server.key"},
+		Prefetch:      true,
+		Authoritative: true,
+		ReadyTimeout:  10,
+	}
+	keepStartupConfig(&config, current)
+
+	want := current.Cached
+	want.Authoritative = true
+	if !reflect.DeepEqual(config.Cached, want) || config.PIDFile != current.PIDFile {
+		t.Errorf("keepStartupConfig() = %+v, want %+v", config.Cached, want)
+	}
+	if config.CacheTTL != 300 {
+		t.Errorf("cache_ttl should be reloaded: %d", config.CacheTTL)
+	}
+
+	// the prefetcher is not started by reload
+	if err := config.Validate(); err == nil {
+		t.Error("authoritative without the running prefetch should be rejected")
+	}
+}
@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/STNS/cache-stnsd/cache_stnsd"
+)
+
+// listenUnix binds the socket on a temporary path, sets the permission and
+// the owner, and then renames it to unix_socket.
+// Clients never see the socket with a wrong permission.
+func listenUnix(cached cache_stnsd.Cached) (net.Listener, error) {
+	sf := cached.UnixSocket
+	mode, err := cached.SocketFileMode()
+	if err != nil {
+		return nil, err
+	}
+
+	uid, gid, err := socketOwner(cached.SocketOwner, cached.SocketGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp := filepath.Join(filepath.Dir(sf), fmt.Sprintf(".%s.%d", filepath.Base(sf), os.Getpid()))
+	if Exists(tmp) {
+		if err := os.Remove(tmp); err != nil {
+			return nil, err
+		}
+	}
+
+	old := syscall.Umask(0177)
+	l, err := net.Listen("unix", tmp)
+	syscall.Umask(old)
+	if err != nil {
+		return nil, err
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if err := setupSocket(tmp, sf, mode, uid, gid); err != nil {
+		l.Close()
+		os.Remove(tmp)
+		return nil, err
+	}
+	return l, nil
+}
+
+func setupSocket(tmp, sf string, mode os.FileMode, uid, gid int) error {
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(tmp, uid, gid); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Chmod(tmp, mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, sf)
+}
+
+// socketOwner resolves the user and group by name or id.
+// It returns -1 for the one that is not set, which os.Chown leaves unchanged.
+func socketOwner(owner, group string) (int, int, error) {
+	uid, gid := -1, -1
+	if owner != "" {
+		u, err := user.Lookup(owner)
+		if err != nil {
+			if u, err = user.LookupId(owner); err != nil {
+				return 0, 0, fmt.Errorf("socket_owner is invalid: %s", owner)
+			}
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			if g, err = user.LookupGroupId(group); err != nil {
+				return 0, 0, fmt.Errorf("socket_group is invalid: %s", group)
+			}
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return 0, 0, err
+		}
+	}
+	return uid, gid, nil
+}
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/STNS/cache-stnsd/cache_stnsd"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir, err := os.MkdirTemp("", "stnsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sf := filepath.Join(dir, "cache-stnsd.sock")
+	// a stale socket file is replaced
+	if err := os.WriteFile(sf, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := listenUnix(cache_stnsd.Cached{
+		UnixSocket:  sf,
+		SocketMode:  "0660",
+		SocketGroup: strconv.Itoa(os.Getgid()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	fi, err := os.Stat(sf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		t.Errorf("%s is not a socket", sf)
+	}
+	if fi.Mode().Perm() != 0660 {
+		t.Errorf("mode = %o, want 0660", fi.Mode().Perm())
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("temporary socket remains: %v", files)
+	}
+}
+
+func TestSocketOwner(t *testing.T) {
+	uid, gid, err := socketOwner("", "")
+	if err != nil || uid != -1 || gid != -1 {
+		t.Errorf("socketOwner() = %d, %d, %v, want -1, -1", uid, gid, err)
+	}
+
+	uid, gid, err = socketOwner(strconv.Itoa(os.Getuid()), strconv.Itoa(os.Getgid()))
+	if err != nil || uid != os.Getuid() || gid != os.Getgid() {
+		t.Errorf("socketOwner() = %d, %d, %v, want %d, %d", uid, gid, err, os.Getuid(), os.Getgid())
+	}
+
+	if _, _, err := socketOwner("no-such-user-for-stnsd", ""); err == nil {
+		t.Error("socketOwner() should fail for unknown user")
+	}
+}
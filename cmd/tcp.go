@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/STNS/cache-stnsd/cache_stnsd"
+	"github.com/STNS/libstns-go/libstns"
+)
+
+// listenTCP listens on [cached] listen.
+// It returns the raw tcp listener to hand over on upgrade and the listener to serve,
+// which is wrapped by TLS when [cached.tls] is set.
+func listenTCP(cached cache_stnsd.Cached, raw net.Listener) (net.Listener, net.Listener, error) {
+	if raw == nil {
+		l, err := net.Listen("tcp", cached.Listen)
+		if err != nil {
+			return nil, nil, err
+		}
+		raw = l
+	}
+
+	if cached.TLS.Cert == "" {
+		return raw, raw, nil
+	}
+
+	tc, err := serverTLSConfig(cached.TLS)
+	if err != nil {
+		raw.Close()
+		return nil, nil, err
+	}
+	return raw, tls.NewListener(raw, tc), nil
+}
+
+func serverTLSConfig(t libstns.TLS) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	tc := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if t.CA != "" {
+		ca, err := os.ReadFile(t.CA)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate in %s", t.CA)
+		}
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tc, nil
+}
@@ -0,0 +1,225 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/STNS/cache-stnsd/cache_stnsd"
+	"github.com/sirupsen/logrus"
+)
+
+// upgradeEnv is set to the new process started by SIGUSR2.
+// The value tells whether the new process owns the socket file ("unlink") or not ("keep").
+const upgradeEnv = "CACHE_STNSD_UPGRADE"
+
+// upgradeTCPEnv is set when the tcp listener is passed too.
+const upgradeTCPEnv = "CACHE_STNSD_UPGRADE_TCP"
+
+// file descriptors passed to the new process
+const (
+	upgradeListenerFd = 3 + iota
+	upgradePidfileFd
+	upgradeSnapshotFd
+	upgradeReadyFd
+	upgradeTCPFd
+)
+
+var upgradeTimeout = 30 * time.Second
+
+// upgradeState is what the new process takes over from the old one.
+type upgradeState struct {
+	listener     net.Listener
+	tcpListener  net.Listener
+	pid          *pidFile
+	snapshot     *os.File
+	ready        *os.File
+	unlinkSocket bool
+}
+
+// inheritUpgrade returns the state passed by the old process.
+// It returns nil if the process was not started by an upgrade.
+func inheritUpgrade(pidPath string) (*upgradeState, error) {
+	mode := os.Getenv(upgradeEnv)
+	if mode == "" {
+		return nil, nil
+	}
+	os.Unsetenv(upgradeEnv)
+
+	lf := os.NewFile(upgradeListenerFd, "listener")
+	defer lf.Close()
+	l, err := net.FileListener(lf)
+	if err != nil {
+		return nil, err
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	// the lock of the pid file is shared with the old process,
+	// which writes the pid of this process after it is ready
+	pf := os.NewFile(upgradePidfileFd, pidPath)
+
+	var tl net.Listener
+	if os.Getenv(upgradeTCPEnv) != "" {
+		os.Unsetenv(upgradeTCPEnv)
+		tf := os.NewFile(upgradeTCPFd, "tcp listener")
+		defer tf.Close()
+		if tl, err = net.FileListener(tf); err != nil {
+			return nil, err
+		}
+	}
+
+	return &upgradeState{
+		listener:     l,
+		tcpListener:  tl,
+		pid:          &pidFile{path: pidPath, f: pf},
+		snapshot:     os.NewFile(upgradeSnapshotFd, "snapshot"),
+		ready:        os.NewFile(upgradeReadyFd, "ready"),
+		unlinkSocket: mode == "unlink",
+	}, nil
+}
+
+// restore loads the cache snapshot and tells the old process that this process is ready.
+func (u *upgradeState) restore(chttp *cache_stnsd.Http) {
+	defer u.snapshot.Close()
+	n, err := chttp.LoadSnapshot(u.snapshot)
+	if err != nil {
+		logrus.Errorf("load cache snapshot failed: %s", err)
+	} else {
+		logrus.Infof("restored cache entries from the old process: %d", n)
+	}
+
+	if _, err := u.ready.Write([]byte("READY")); err != nil {
+		logrus.Errorf("notify ready to the old process failed: %s", err)
+	}
+	u.ready.Close()
+}
+
+// startUpgrade starts the new binary with the listener, the pid file and the cache snapshot,
+// and waits until it is ready to serve.
+// tcpListener is nil if [cached] listen is not set.
+func startUpgrade(l, tcpListener net.Listener, pid *pidFile, chttp *cache_stnsd.Http, unlinkSocket bool) (*os.Process, error) {
+	lf, err := listenerFile(l)
+	if err != nil {
+		return nil, err
+	}
+	defer lf.Close()
+
+	env := append(upgradeEnviron(os.Environ()), upgradeEnv+"="+unlinkMode(unlinkSocket))
+	var tf *os.File
+	if tcpListener != nil {
+		tf, err = listenerFile(tcpListener)
+		if err != nil {
+			return nil, err
+		}
+		defer tf.Close()
+		env = append(env, upgradeTCPEnv+"=1")
+	}
+
+	snapshot, err := os.CreateTemp("", "cache-stnsd-snapshot")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(snapshot.Name())
+	defer snapshot.Close()
+
+	if err := chttp.WriteSnapshot(snapshot); err != nil {
+		return nil, err
+	}
+	if _, err := snapshot.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	cmd, err := upgradeCommand()
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = env
+	cmd.ExtraFiles = []*os.File{lf, pid.f, snapshot, w}
+	if tf != nil {
+		cmd.ExtraFiles = append(cmd.ExtraFiles, tf)
+	}
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		b := make([]byte, 5)
+		_, err := io.ReadFull(r, b)
+		ready <- err
+	}()
+
+	select {
+	case err := <-ready:
+		if err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return nil, fmt.Errorf("new process exited before ready: %s", err)
+		}
+	case <-time.After(upgradeTimeout):
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("new process is not ready in %s", upgradeTimeout)
+	}
+
+	// the pid file points to this process until the new one is ready
+	if err := pid.write(cmd.Process.Pid); err != nil {
+		logrus.Errorf("write the pid of the new process to %s failed: %s", pid.path, err)
+	}
+
+	// don't leave the new process as a zombie of this process
+	go cmd.Wait()
+	return cmd.Process, nil
+}
+
+// upgradeCommand returns the command of the new process, the same binary with the same arguments.
+var upgradeCommand = func() (*exec.Cmd, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	return exec.Command(exe, os.Args[1:]...), nil
+}
+
+// upgradeEnviron returns the environment of the new process.
+// WATCHDOG_PID is the pid of this process, and the new process becomes the main pid of systemd.
+func upgradeEnviron(environ []string) []string {
+	env := []string{}
+	for _, e := range environ {
+		if strings.HasPrefix(e, "WATCHDOG_PID=") {
+			continue
+		}
+		env = append(env, e)
+	}
+	return env
+}
+
+func listenerFile(l net.Listener) (*os.File, error) {
+	fl, ok := l.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("listener can't be passed: %T", l)
+	}
+	return fl.File()
+}
+
+func unlinkMode(unlinkSocket bool) string {
+	if unlinkSocket {
+		return "unlink"
+	}
+	return "keep"
+}
@@ -0,0 +1,171 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ReneKroon/ttlcache/v2"
+	"github.com/STNS/cache-stnsd/cache_stnsd"
+)
+
+// upgradeHelperEnv runs TestUpgradeHelperProcess as the new process.
+const upgradeHelperEnv = "CACHE_STNSD_TEST_UPGRADE"
+
+// TestUpgradeHelperProcess is the new process started by startUpgrade in the tests.
+// It tells the restored entries and the watchdog interval to the first client.
+func TestUpgradeHelperProcess(t *testing.T) {
+	switch os.Getenv(upgradeHelperEnv) {
+	case "":
+		return
+	case "exit":
+		os.Exit(1)
+	case "hang":
+		time.Sleep(time.Minute)
+		os.Exit(1)
+	}
+
+	up, err := inheritUpgrade("cache-stnsd.pid")
+	if err != nil || up == nil {
+		fmt.Fprintf(os.Stderr, "inheritUpgrade() = %v, %v\n", up, err)
+		os.Exit(2)
+	}
+
+	cache := ttlcache.NewCache()
+	chttp, err := cache_stnsd.NewHttp(&cache_stnsd.Config{ApiEndpoint: "http://localhost:1104/v1", Cache: true, CacheTTL: 600}, cache, "test")
+	if err != nil {
+		os.Exit(2)
+	}
+	up.restore(chttp)
+
+	conn, err := up.listener.Accept()
+	if err != nil {
+		os.Exit(2)
+	}
+	fmt.Fprintf(conn, "entries=%d watchdog=%s\n", cache.Count(), watchdogInterval())
+	conn.Close()
+	os.Exit(0)
+}
+
+func startUpgradeHelper(t *testing.T, mode string) (string, *pidFile, *os.Process, error) {
+	t.Setenv(upgradeHelperEnv, mode)
+	command := upgradeCommand
+	upgradeCommand = func() (*exec.Cmd, error) {
+		return exec.Command(os.Args[0], "-test.run=^TestUpgradeHelperProcess$"), nil
+	}
+	t.Cleanup(func() { upgradeCommand = command })
+
+	dir := t.TempDir()
+	sock := filepath.Join(dir, "cache-stnsd.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	pid, err := lockPidfile(filepath.Join(dir, "cache-stnsd.pid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pid.Remove() })
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"id":1000,"name":"alice"}]`))
+	}))
+	t.Cleanup(ts.Close)
+
+	cache := ttlcache.NewCache()
+	t.Cleanup(func() { cache.Close() })
+	chttp, err := cache_stnsd.NewHttp(&cache_stnsd.Config{ApiEndpoint: ts.URL, Cache: true, CacheTTL: 600}, cache, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := chttp.Request("users", "name=alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := startUpgrade(l, nil, pid, chttp, false)
+	return sock, pid, p, err
+}
+
+func readPid(t *testing.T, pid *pidFile) int {
+	b, err := os.ReadFile(pid.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestStartUpgrade(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+
+	sock, pid, p, err := startUpgradeHelper(t, "serve")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readPid(t, pid); got != p.Pid {
+		t.Errorf("pidfile = %d, want the new process %d", got, p.Pid)
+	}
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "entries=1 watchdog=15s\n"; line != want {
+		t.Errorf("new process = %q, want %q", line, want)
+	}
+}
+
+func TestStartUpgradeFailure(t *testing.T) {
+	timeout := upgradeTimeout
+	upgradeTimeout = 500 * time.Millisecond
+	defer func() { upgradeTimeout = timeout }()
+
+	tests := []struct {
+		mode    string
+		wantErr string
+	}{
+		{"exit", "new process exited before ready"},
+		{"hang", "new process is not ready in 500ms"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			_, pid, p, err := startUpgradeHelper(t, tt.mode)
+			if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+				t.Errorf("startUpgrade() = %v, %v, want %q", p, err, tt.wantErr)
+			}
+			if got := readPid(t, pid); got != os.Getpid() {
+				t.Errorf("pidfile = %d, want this process %d", got, os.Getpid())
+			}
+		})
+	}
+}
+
+func TestUpgradeEnviron(t *testing.T) {
+	got := upgradeEnviron([]string{"PATH=/bin", "WATCHDOG_PID=1", "WATCHDOG_USEC=30000000", "NOTIFY_SOCKET=/run/notify"})
+	want := []string{"PATH=/bin", "WATCHDOG_USEC=30000000", "NOTIFY_SOCKET=/run/notify"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("upgradeEnviron() = %v, want %v", got, want)
+	}
+}
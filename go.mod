@@ -7,7 +7,8 @@ require (
 	github.com/ReneKroon/ttlcache/v2 v2.11.0
 	github.com/STNS/STNS/v2 v2.2.15
 	github.com/STNS/libstns-go v0.4.3
-	github.com/facebookgo/pidfile v0.0.0-20150612191647-f242e2999868
+	github.com/caarlos0/env v3.5.0+incompatible
+	github.com/hashicorp/go-retryablehttp v0.7.7
 	github.com/k0kubun/pp v3.0.1+incompatible
 	github.com/lib/pq v1.10.9
 	github.com/sirupsen/logrus v1.9.3
@@ -16,14 +17,11 @@ require (
 )
 
 require (
-	github.com/caarlos0/env v3.5.0+incompatible // indirect
-	github.com/facebookgo/atomicfile v0.0.0-20151019160806-2de1f203e7d5 // indirect
 	github.com/fsnotify/fsnotify v1.9.0 // indirect
 	github.com/go-playground/locales v0.14.1 // indirect
 	github.com/go-playground/universal-translator v0.18.1 // indirect
 	github.com/go-viper/mapstructure/v2 v2.4.0 // indirect
 	github.com/hashicorp/go-cleanhttp v0.5.2 // indirect
-	github.com/hashicorp/go-retryablehttp v0.7.7 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/labstack/gommon v0.4.2 // indirect
 	github.com/leodido/go-urn v1.4.0 // indirect